@@ -0,0 +1,224 @@
+// Command pdujournal prints the PDU journals routes record and replays the
+// submits in them against a test smsc.
+//
+//	pdujournal print test_smsc.pdu.jsonl
+//	pdujournal replay -addr localhost:2775 -user test -password secret test_smsc.pdu.jsonl
+package main
+
+import (
+	"antinvestor.com/service/routep/pdujournal"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/fiorix/go-smpp/smpp"
+	"github.com/fiorix/go-smpp/smpp/pdu"
+	"github.com/fiorix/go-smpp/smpp/pdu/pdufield"
+	"github.com/fiorix/go-smpp/smpp/pdu/pdutext"
+	"github.com/fiorix/go-smpp/smpp/pdu/pdutlv"
+	"os"
+	"strconv"
+	"time"
+)
+
+func main() {
+
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "print":
+		err = printJournals(os.Args[2:])
+	case "replay":
+		err = replayJournals(os.Args[2:])
+	default:
+		usage()
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: pdujournal print [-direction inbound|outbound] [-command SubmitSM] FILE...")
+	fmt.Fprintln(os.Stderr, "       pdujournal replay -addr HOST:PORT [-user USER] [-password PASSWORD] [-system-type TYPE] [-rate N] FILE...")
+	os.Exit(2)
+}
+
+func readJournals(files []string, fn func(record *pdujournal.Record) error) error {
+
+	if len(files) == 0 {
+		return errors.New("no journal files were given")
+	}
+
+	for _, file := range files {
+		journal, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+
+		err = pdujournal.Read(journal, fn)
+		_ = journal.Close()
+		if err != nil {
+			return fmt.Errorf("%s : %w", file, err)
+		}
+	}
+	return nil
+}
+
+func printJournals(args []string) error {
+
+	flags := flag.NewFlagSet("print", flag.ExitOnError)
+	direction := flags.String("direction", "", "only print pdus in this direction")
+	command := flags.String("command", "", "only print pdus of this command e.g. DeliverSM")
+	_ = flags.Parse(args)
+
+	return readJournals(flags.Args(), func(record *pdujournal.Record) error {
+		if (*direction != "" && record.Direction != *direction) || (*command != "" && record.Command != *command) {
+			return nil
+		}
+		fmt.Println(pdujournal.Format(record))
+		return nil
+	})
+}
+
+func replayJournals(args []string) error {
+
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	addr := flags.String("addr", "", "address of the test smsc to replay submits against")
+	user := flags.String("user", "", "system id to bind with")
+	password := flags.String("password", "", "password to bind with")
+	systemType := flags.String("system-type", "", "system type to bind with")
+	rate := flags.Int("rate", 10, "submits per second")
+	_ = flags.Parse(args)
+
+	if *addr == "" {
+		return errors.New("the address of a test smsc is required to replay against")
+	}
+	if *rate < 1 {
+		*rate = 1
+	}
+
+	tx := &smpp.Transmitter{
+		Addr:       *addr,
+		User:       *user,
+		Passwd:     *password,
+		SystemType: *systemType,
+	}
+
+	status := <-tx.Bind()
+	if status.Status() != smpp.Connected {
+		return fmt.Errorf("could not bind to %s : %v", *addr, status.Error())
+	}
+	defer tx.Close()
+
+	ticker := time.NewTicker(time.Second / time.Duration(*rate))
+	defer ticker.Stop()
+
+	replayed := 0
+	err := readJournals(flags.Args(), func(record *pdujournal.Record) error {
+		if record.Direction != pdujournal.Outbound || record.Command != pdu.SubmitSMID.String() {
+			return nil
+		}
+
+		sm, err := shortMessage(record)
+		if err != nil {
+			return fmt.Errorf("could not rebuild submit from %v : %w", record.Time, err)
+		}
+
+		<-ticker.C
+		resp, err := tx.Submit(sm)
+		replayed++
+		if err != nil {
+			fmt.Printf("%v %s -> %s : %v\n", record.Time.Format(time.RFC3339), sm.Src, sm.Dst, err)
+			return nil
+		}
+		fmt.Printf("%v %s -> %s : accepted as %s\n", record.Time.Format(time.RFC3339), sm.Src, sm.Dst, resp.RespID())
+		return nil
+	})
+
+	fmt.Printf("replayed %d submits\n", replayed)
+	return err
+}
+
+// shortMessage rebuilds the short message a recorded submit_sm was sent for
+func shortMessage(record *pdujournal.Record) (*smpp.ShortMessage, error) {
+
+	field := func(name pdufield.Name) ([]byte, error) {
+		value, ok := record.Fields[string(name)]
+		if !ok {
+			return nil, nil
+		}
+		return value.Bytes()
+	}
+
+	octet := func(name pdufield.Name) (uint8, error) {
+		data, err := field(name)
+		if err != nil || len(data) == 0 {
+			return 0, err
+		}
+		return data[0], nil
+	}
+
+	cString := func(name pdufield.Name) (string, error) {
+		data, err := field(name)
+		if err != nil {
+			return "", err
+		}
+		if len(data) > 0 && data[len(data)-1] == 0x00 {
+			data = data[:len(data)-1]
+		}
+		return string(data), nil
+	}
+
+	sm := &smpp.ShortMessage{TLVFields: pdutlv.Fields{}}
+
+	var err error
+	if sm.Src, err = cString(pdufield.SourceAddr); err != nil {
+		return nil, err
+	}
+	if sm.Dst, err = cString(pdufield.DestinationAddr); err != nil {
+		return nil, err
+	}
+
+	text, err := field(pdufield.ShortMessage)
+	if err != nil {
+		return nil, err
+	}
+	sm.Text = pdutext.Raw(text)
+
+	for name, value := range map[pdufield.Name]*uint8{
+		pdufield.SourceAddrTON: &sm.SourceAddrTON,
+		pdufield.SourceAddrNPI: &sm.SourceAddrNPI,
+		pdufield.DestAddrTON:   &sm.DestAddrTON,
+		pdufield.DestAddrNPI:   &sm.DestAddrNPI,
+		pdufield.ESMClass:      &sm.ESMClass,
+	} {
+		if *value, err = octet(name); err != nil {
+			return nil, err
+		}
+	}
+
+	register, err := octet(pdufield.RegisteredDelivery)
+	if err != nil {
+		return nil, err
+	}
+	sm.Register = pdufield.DeliverySetting(register)
+
+	for tagHex, value := range record.TLVs {
+		tag, err := strconv.ParseUint(tagHex, 16, 16)
+		if err != nil {
+			return nil, err
+		}
+		data, err := value.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		sm.TLVFields[pdutlv.Tag(tag)] = data
+	}
+
+	return sm, nil
+}
@@ -6,6 +6,9 @@ import (
 	"log"
 	"os"
 	"time"
+
+	// The image has no zoneinfo for the dlr timezones of routes to load from
+	_ "time/tzdata"
 )
 
 func main() {
@@ -25,17 +28,17 @@ func main() {
 
 	queue, err := utils.ConfigureQueue(logger)
 	if err != nil {
-		logger.Warnf("Configuring StanQueue experienced an error: %v", err)
+		logger.Warnf("Configuring queue experienced an error: %v", err)
 		os.Exit(1)
 	}
-	defer queue.Close()
 
 	logger.Infof("Initiating the service at %v", time.Now())
 
 	env := service.Env{
-		Queue:      queue,
-		Logger:     logger,
-		ServerPort: utils.GetEnv("SERVER_PORT", "7000"),
+		Queue:       queue,
+		ServiceName: serviceName,
+		Logger:      logger,
+		ServerPort:  utils.GetEnv("SERVER_PORT", "7000"),
 	}
 
 	service.RunServer(&env)
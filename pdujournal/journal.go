@@ -0,0 +1,254 @@
+// Package pdujournal records the SMPP PDUs exchanged with an smsc to a
+// rotating file of json lines so that disputes with carriers can be settled
+// from what was actually sent and received.
+package pdujournal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/fiorix/go-smpp/smpp/pdu"
+	"github.com/fiorix/go-smpp/smpp/pdu/pdufield"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	// Inbound PDUs were received from the smsc
+	Inbound = "inbound"
+	// Outbound PDUs were sent to the smsc
+	Outbound = "outbound"
+)
+
+// Value is a PDU field or TLV, hex holds its exact bytes and text a
+// readable form when the bytes are printable
+type Value struct {
+	Text string `json:"text,omitempty"`
+	Hex  string `json:"hex"`
+}
+
+// Bytes decodes the exact value of the field
+func (v Value) Bytes() ([]byte, error) {
+	return hex.DecodeString(v.Hex)
+}
+
+// Record is a PDU as it was exchanged with an smsc, raw holds the bytes that
+// crossed the connection when the PDU was captured off it
+type Record struct {
+	Time      time.Time        `json:"time"`
+	RouteID   string           `json:"route_id"`
+	Subroute  string           `json:"subroute"`
+	Direction string           `json:"direction"`
+	Command   string           `json:"command"`
+	Status    string           `json:"status"`
+	Sequence  uint32           `json:"sequence"`
+	Fields    map[string]Value `json:"fields,omitempty"`
+	TLVs      map[string]Value `json:"tlvs,omitempty"`
+	Raw       string           `json:"raw,omitempty"`
+}
+
+func newValue(data []byte) Value {
+	value := Value{Hex: hex.EncodeToString(data)}
+
+	text := strings.TrimRight(string(data), "\x00")
+	for _, c := range text {
+		if !unicode.IsPrint(c) {
+			return value
+		}
+	}
+	value.Text = text
+	return value
+}
+
+// NewRecord captures a PDU
+func NewRecord(routeID string, subroute string, direction string, p pdu.Body) *Record {
+
+	header := p.Header()
+	record := &Record{
+		Time:      time.Now().UTC(),
+		RouteID:   routeID,
+		Subroute:  subroute,
+		Direction: direction,
+		Command:   header.ID.String(),
+		Status:    header.Status.Error(),
+		Sequence:  header.Seq,
+		Fields:    make(map[string]Value),
+		TLVs:      make(map[string]Value),
+	}
+
+	for name, field := range p.Fields() {
+		if field != nil {
+			record.Fields[string(name)] = newValue(field.Bytes())
+		}
+	}
+
+	for tag, field := range p.TLVFields() {
+		if field != nil {
+			record.TLVs[tag.Hex()] = newValue(field.Bytes())
+		}
+	}
+
+	return record
+}
+
+// Options configure where a journal is written and how it is rotated
+type Options struct {
+	File       string
+	MaxSizeMB  int
+	MaxBackups int
+	MaxAgeDays int
+}
+
+// Journal appends records to a file that is rotated by size
+type Journal struct {
+	mu     sync.Mutex
+	output *lumberjack.Logger
+}
+
+// New opens the journal, records are appended to any existing file
+func New(options Options) *Journal {
+	return &Journal{
+		output: &lumberjack.Logger{
+			Filename:   options.File,
+			MaxSize:    options.MaxSizeMB,
+			MaxBackups: options.MaxBackups,
+			MaxAge:     options.MaxAgeDays,
+			Compress:   true,
+		},
+	}
+}
+
+// Record writes a PDU to the journal, a nil journal records nothing
+func (j *Journal) Record(routeID string, subroute string, direction string, p pdu.Body) error {
+	if j == nil || p == nil {
+		return nil
+	}
+
+	return j.write(NewRecord(routeID, subroute, direction, p))
+}
+
+// RecordBytes writes a PDU as it crossed the connection. Commands the smpp
+// library can't decode are recorded by their header, and the password of
+// binds is left out.
+func (j *Journal) RecordBytes(routeID string, subroute string, direction string, data []byte) error {
+	if j == nil {
+		return nil
+	}
+
+	var record *Record
+	p, err := pdu.Decode(bytes.NewReader(data))
+	if err == nil && p != nil {
+		record = NewRecord(routeID, subroute, direction, p)
+	} else {
+		header, err := pdu.DecodeHeader(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		record = &Record{
+			Time:      time.Now().UTC(),
+			RouteID:   routeID,
+			Subroute:  subroute,
+			Direction: direction,
+			Command:   header.ID.String(),
+			Status:    header.Status.Error(),
+			Sequence:  header.Seq,
+		}
+	}
+
+	if _, ok := record.Fields[string(pdufield.Password)]; ok {
+		delete(record.Fields, string(pdufield.Password))
+	} else {
+		record.Raw = hex.EncodeToString(data)
+	}
+
+	return j.write(record)
+}
+
+func (j *Journal) write(record *Record) error {
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	_, err = j.output.Write(append(line, '\n'))
+	return err
+}
+
+// Close flushes and closes the journal file
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.output.Close()
+}
+
+// Read calls fn with every record in a journal file
+func Read(r io.Reader, fn func(record *Record) error) error {
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+
+		record := &Record{}
+		err := json.Unmarshal(scanner.Bytes(), record)
+		if err != nil {
+			return fmt.Errorf("line %d is not a journal record : %w", line, err)
+		}
+
+		err = fn(record)
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Format renders a record for reading
+func Format(record *Record) string {
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "%s %-8s %s seq=%d status=%q route=%s subroute=%s\n", record.Time.Format(time.RFC3339Nano),
+		record.Direction, record.Command, record.Sequence, record.Status, record.RouteID, record.Subroute)
+
+	writeValues := func(prefix string, values map[string]Value) {
+		names := make([]string, 0, len(values))
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			value := values[name]
+			if value.Text != "" {
+				fmt.Fprintf(&out, "    %s%-24s %q (0x%s)\n", prefix, name, value.Text, value.Hex)
+			} else {
+				fmt.Fprintf(&out, "    %s%-24s 0x%s\n", prefix, name, value.Hex)
+			}
+		}
+	}
+
+	writeValues("", record.Fields)
+	writeValues("tlv:", record.TLVs)
+	if record.Raw != "" {
+		fmt.Fprintf(&out, "    %-28s 0x%s\n", "raw", record.Raw)
+	}
+	return out.String()
+}
@@ -0,0 +1,51 @@
+package pdujournal
+
+import (
+	"github.com/fiorix/go-smpp/smpp/pdu"
+	"github.com/fiorix/go-smpp/smpp/pdu/pdufield"
+	"github.com/fiorix/go-smpp/smpp/pdu/pdutlv"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournalRoundTrip(t *testing.T) {
+
+	file := filepath.Join(t.TempDir(), "test.pdu.jsonl")
+	journal := New(Options{File: file, MaxSizeMB: 1})
+
+	submit := pdu.NewSubmitSM(pdutlv.Fields{pdutlv.TagReceiptedMessageID: "abc123"})
+	assert.NoError(t, submit.Fields().Set(pdufield.SourceAddr, "22333"))
+	assert.NoError(t, submit.Fields().Set(pdufield.DestinationAddr, "254700000001"))
+	assert.NoError(t, submit.Fields().Set(pdufield.ShortMessage, []byte{0x48, 0x69, 0x01}))
+
+	assert.NoError(t, journal.Record("test_smsc", "localhost:2775", Outbound, submit))
+	assert.NoError(t, journal.Record("test_smsc", "localhost:2775", Inbound, nil))
+	assert.NoError(t, journal.Close())
+
+	input, err := os.Open(file)
+	assert.NoError(t, err)
+	defer input.Close()
+
+	var records []*Record
+	assert.NoError(t, Read(input, func(record *Record) error {
+		records = append(records, record)
+		return nil
+	}))
+
+	if assert.Len(t, records, 1) {
+		record := records[0]
+		assert.Equal(t, Outbound, record.Direction)
+		assert.Equal(t, "SubmitSM", record.Command)
+		assert.Equal(t, "22333", record.Fields[string(pdufield.SourceAddr)].Text)
+
+		message, err := record.Fields[string(pdufield.ShortMessage)].Bytes()
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{0x48, 0x69, 0x01}, message)
+		assert.Empty(t, record.Fields[string(pdufield.ShortMessage)].Text)
+
+		assert.Equal(t, "abc123", record.TLVs[pdutlv.TagReceiptedMessageID.Hex()].Text)
+		assert.Contains(t, Format(record), "SubmitSM")
+	}
+}
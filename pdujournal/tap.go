@@ -0,0 +1,167 @@
+package pdujournal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/fiorix/go-smpp/smpp/pdu"
+	"io"
+	"net"
+	"sync"
+)
+
+// Tap relays connections to an smsc through a local address and records every
+// PDU that crosses them to the journal, in both directions and with the bytes
+// and sequence numbers that were on the wire. The smpp client dials the tap in
+// place of the smsc.
+type Tap struct {
+	journal  *Journal
+	routeID  string
+	subroute string
+	addr     string
+	report   func(err error)
+	listener net.Listener
+
+	mu     sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool
+}
+
+// Tap starts relaying to the smsc at addr, report is called with the errors
+// that come up recording PDUs
+func (j *Journal) Tap(routeID string, subroute string, addr string, report func(err error)) (*Tap, error) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	tap := &Tap{
+		journal:  j,
+		routeID:  routeID,
+		subroute: subroute,
+		addr:     addr,
+		report:   report,
+		listener: listener,
+		conns:    make(map[net.Conn]bool),
+	}
+	go tap.serve()
+	return tap, nil
+}
+
+// Addr is the local address the smpp client dials
+func (t *Tap) Addr() string {
+	return t.listener.Addr().String()
+}
+
+// Close stops relaying and drops the connections that are open
+func (t *Tap) Close() error {
+	t.mu.Lock()
+	t.closed = true
+	for conn := range t.conns {
+		_ = conn.Close()
+	}
+	t.mu.Unlock()
+
+	return t.listener.Close()
+}
+
+// track keeps a connection so closing the tap closes it, it is false once the tap is closed
+func (t *Tap) track(conn net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		_ = conn.Close()
+		return false
+	}
+	t.conns[conn] = true
+	return true
+}
+
+func (t *Tap) forget(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	_ = conn.Close()
+	delete(t.conns, conn)
+}
+
+func (t *Tap) serve() {
+	for {
+		client, err := t.listener.Accept()
+		if err != nil {
+			return
+		}
+		go t.relay(client)
+	}
+}
+
+func (t *Tap) relay(client net.Conn) {
+
+	if !t.track(client) {
+		return
+	}
+	defer t.forget(client)
+
+	smsc, err := net.Dial("tcp", t.addr)
+	if err != nil {
+		t.report(err)
+		return
+	}
+	if !t.track(smsc) {
+		return
+	}
+	defer t.forget(smsc)
+
+	// Either side going away ends the relay
+	done := make(chan struct{}, 2)
+	go func() {
+		t.copy(smsc, client, Outbound)
+		done <- struct{}{}
+	}()
+	go func() {
+		t.copy(client, smsc, Inbound)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// copy passes PDUs on one at a time recording each once it is passed on. A
+// stream that stops making sense as PDUs is passed on as it is.
+func (t *Tap) copy(dst net.Conn, src net.Conn, direction string) {
+
+	length := make([]byte, 4)
+	for {
+		_, err := io.ReadFull(src, length)
+		if err != nil {
+			return
+		}
+
+		size := binary.BigEndian.Uint32(length)
+		if size < pdu.HeaderLen || size > pdu.MaxSize {
+			t.report(fmt.Errorf("%s stream of %s has a pdu of %d bytes, it is no longer recorded", direction, t.addr, size))
+			_, err = dst.Write(length)
+			if err == nil {
+				_, _ = io.Copy(dst, src)
+			}
+			return
+		}
+
+		data := make([]byte, size)
+		copy(data, length)
+		_, err = io.ReadFull(src, data[4:])
+		if err != nil {
+			return
+		}
+
+		_, err = dst.Write(data)
+		if err != nil {
+			return
+		}
+
+		err = t.journal.RecordBytes(t.routeID, t.subroute, direction, data)
+		if err != nil {
+			t.report(err)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package pdujournal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fiorix/go-smpp/smpp"
+	"github.com/fiorix/go-smpp/smpp/pdu"
+	"github.com/fiorix/go-smpp/smpp/pdu/pdufield"
+	"github.com/fiorix/go-smpp/smpp/pdu/pdutext"
+	"github.com/fiorix/go-smpp/smpp/smpptest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTapRecordsTheWireBothWays(t *testing.T) {
+
+	server := smpptest.NewUnstartedServer()
+	server.Handler = func(c smpptest.Conn, p pdu.Body) {
+		var resp pdu.Body
+		switch p.Header().ID {
+		case pdu.SubmitSMID:
+			resp = pdu.NewSubmitSMResp()
+			_ = resp.Fields().Set(pdufield.MessageID, "0a1b2c")
+		case pdu.UnbindID:
+			resp = pdu.NewUnbindResp()
+		default:
+			return
+		}
+		resp.Header().Seq = p.Header().Seq
+		_ = c.Write(resp)
+	}
+	server.Start()
+	defer server.Close()
+
+	file := filepath.Join(t.TempDir(), "test.pdu.jsonl")
+	journal := New(Options{File: file, MaxSizeMB: 1})
+	defer journal.Close()
+
+	tap, err := journal.Tap("test_smsc", server.Addr(), server.Addr(), func(err error) {
+		t.Errorf("recording failed : %v", err)
+	})
+	assert.NoError(t, err)
+	defer tap.Close()
+
+	trx := &smpp.Transceiver{Addr: tap.Addr(), User: smpptest.DefaultUser, Passwd: smpptest.DefaultPasswd}
+	connStat := trx.Bind()
+	select {
+	case c := <-connStat:
+		assert.Equal(t, smpp.Connected, c.Status())
+	case <-time.After(5 * time.Second):
+		t.Fatal("never bound through the tap")
+	}
+
+	sm, err := trx.Submit(&smpp.ShortMessage{Src: "22333", Dst: "254700000001", Text: pdutext.Raw("Hello")})
+	assert.NoError(t, err)
+	assert.Equal(t, "0a1b2c", sm.RespID())
+	assert.NoError(t, trx.Close())
+
+	records := make(map[string]*Record)
+	assert.Eventually(t, func() bool {
+		input, err := os.Open(file)
+		if err != nil {
+			return false
+		}
+		defer input.Close()
+
+		_ = Read(input, func(record *Record) error {
+			records[record.Direction+" "+record.Command] = record
+			return nil
+		})
+		return records[Outbound+" Unbind"] != nil
+	}, 5*time.Second, 50*time.Millisecond)
+
+	bind := records[Outbound+" BindTransceiver"]
+	if assert.NotNil(t, bind) {
+		assert.Equal(t, smpptest.DefaultUser, bind.Fields[string(pdufield.SystemID)].Text)
+		assert.NotContains(t, bind.Fields, string(pdufield.Password))
+		assert.Empty(t, bind.Raw, "the raw bind carries the password")
+	}
+	assert.NotNil(t, records[Inbound+" BindTransceiverResp"])
+
+	submit, resp := records[Outbound+" SubmitSM"], records[Inbound+" SubmitSMResp"]
+	if assert.NotNil(t, submit) && assert.NotNil(t, resp) {
+		assert.NotZero(t, submit.Sequence)
+		assert.Equal(t, submit.Sequence, resp.Sequence)
+		assert.Equal(t, "Hello", submit.Fields[string(pdufield.ShortMessage)].Text)
+		assert.NotEmpty(t, submit.Raw)
+		assert.Equal(t, "0a1b2c", resp.Fields[string(pdufield.MessageID)].Text)
+	}
+}
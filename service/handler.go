@@ -2,14 +2,18 @@ package service
 
 import (
 	"antinvestor.com/service/routep/service/sms"
+	"antinvestor.com/service/routep/utils"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"github.com/thedevsaddam/govalidator"
-	"go.opentelemetry.io/otel/api/global"
 
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 )
 
@@ -56,7 +60,7 @@ func addHandler(env *Env, router *mux.Router,
 	})
 	loggedHandler := Logger(handler, name, env.Logger)
 
-	router.Methods(method).Path(path).Name(name).Handler(limit(loggedHandler))
+	router.Methods(method).Path(path).Name(name).Handler(Instrument(limit(loggedHandler), name))
 
 }
 
@@ -66,6 +70,14 @@ func NewRouter(env *Env) *mux.Router {
 
 	addHandler(env, router, SendSms, "/", "SendSms", "POST")
 	addHandler(env, router, Healthz, "/healthz", "Healthz", "GET")
+	addHandler(env, router, HealthzBacklog, "/healthz/backlog", "HealthzBacklog", "GET")
+	router.Methods("GET").Path("/metrics").Name("Metrics").Handler(promhttp.Handler())
+	addHandler(env, router, ListWebhookDeadLetters, "/routes/{route_id}/webhooks/deadletters", "ListWebhookDeadLetters", "GET")
+	addHandler(env, router, ReplayWebhookDeadLetter, "/routes/{route_id}/webhooks/deadletters/{id}/replay", "ReplayWebhookDeadLetter", "POST")
+	addHandler(env, router, ListMessageDeadLetters, "/routes/{route_id}/messages/deadletters", "ListMessageDeadLetters", "GET")
+	addHandler(env, router, ReplayMessageDeadLetter, "/routes/{route_id}/messages/deadletters/{id}/replay", "ReplayMessageDeadLetter", "POST")
+	addHandler(env, router, CancelScheduledSms, "/routes/{route_id}/messages/scheduled/{message_id}", "CancelScheduledSms", "DELETE")
+	addHandler(env, router, RouteStatus, "/routes/{route_id}/status", "RouteStatus", "GET")
 
 	return router
 }
@@ -73,9 +85,8 @@ func NewRouter(env *Env) *mux.Router {
 // SendSms -
 func SendSms(env *Env, w http.ResponseWriter, r *http.Request) error {
 
-	tracer := global.Tracer(env.ServiceName)
-	span, _ := tracer.Start(r.Context(), "SendSms")
-	defer span.Done()
+	ctx, span := utils.StartSpan(utils.ExtractTraceHeaders(r.Context(), r.Header), "SendSms")
+	defer span.End()
 
 	rules := govalidator.MapData{
 		"from":       []string{"required", "max:20"},
@@ -115,13 +126,93 @@ func SendSms(env *Env, w http.ResponseWriter, r *http.Request) error {
 		RouteID:   r.FormValue("route_id"),
 	}
 
+	callbackUrls := make(map[string]*url.URL)
+	for field, callbackUrl := range map[string]string{"ack_url": r.FormValue("ack_url"), "dlr_url": r.FormValue("dlr_url")} {
+		if callbackUrl == "" {
+			continue
+		}
+
+		parsedUrl, err := url.ParseRequestURI(callbackUrl)
+		if err != nil || (parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https") || parsedUrl.Host == "" {
+			return StatusError{400, fmt.Errorf("%s should be a valid http or https url", field)}
+		}
+		callbackUrls[field] = parsedUrl
+	}
+	if transactional := r.FormValue("transactional"); transactional != "" {
+		isTransactional, err := strconv.ParseBool(transactional)
+		if err != nil {
+			return StatusError{400, errors.New("transactional should be either true or false")}
+		}
+		messageMO.Transactional = isTransactional
+	}
+
+	if expiresAt := r.FormValue("expires_at"); expiresAt != "" {
+		expiryTime, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return StatusError{400, errors.New("expires_at should be an RFC3339 timestamp e.g. 2020-01-02T15:04:05Z")}
+		}
+		messageMO.ExpiresAt = &expiryTime
+	} else if ttl := r.FormValue("ttl"); ttl != "" {
+		ttlSeconds, err := strconv.ParseUint(ttl, 10, 32)
+		if err != nil || ttlSeconds == 0 {
+			return StatusError{400, errors.New("ttl should be the number of seconds the message is valid for")}
+		}
+		expiryTime := time.Now().Add(time.Duration(ttlSeconds) * time.Second)
+		messageMO.ExpiresAt = &expiryTime
+	}
+
+	if sendAt := r.FormValue("send_at"); sendAt != "" {
+		sendTime, err := time.Parse(time.RFC3339, sendAt)
+		if err != nil {
+			return StatusError{400, errors.New("send_at should be an RFC3339 timestamp e.g. 2020-01-02T15:04:05Z")}
+		}
+		if messageMO.ExpiresAt != nil && messageMO.ExpiresAt.Before(sendTime) {
+			return StatusError{400, errors.New("expires_at should be after send_at")}
+		}
+		messageMO.SendAt = &sendTime
+	}
+
+	if priority := r.FormValue("priority"); priority != "" {
+		if !sms.IsValidPriority(priority) {
+			return StatusError{400, fmt.Errorf("priority should be one of %v", sms.Priorities)}
+		}
+		messageMO.Priority = priority
+	}
+
+	messageMO.TraceContext = utils.InjectTraceContext(ctx)
+	messageMO.AckURL = r.FormValue("ack_url")
+	messageMO.DLRURL = r.FormValue("dlr_url")
+
+	if metadata := r.FormValue("metadata"); metadata != "" {
+		err := json.Unmarshal([]byte(metadata), &messageMO.Metadata)
+		if err != nil {
+			return StatusError{400, errors.New("metadata should be a json object of string values")}
+		}
+	}
+
 	smsRoute := env.SMSServer.GetRoute(messageMO.RouteID)
 	if smsRoute == nil {
 		return StatusError{500, errors.New("No active routes were found")}
 	}
 
+	for field, callbackUrl := range callbackUrls {
+		if !smsRoute.AllowsCallbackURL(callbackUrl) {
+			return StatusError{400, fmt.Errorf("%s host %s is not allowed for the route", field, callbackUrl.Host)}
+		}
+	}
+
 	ack, err := smsRoute.SendMOMessage(&messageMO)
 	if err != nil {
+		if err == sms.ErrRecipientSuppressed {
+			return StatusError{403, err}
+		}
+		if err == sms.ErrScheduleTooFarAhead {
+			return StatusError{400, err}
+		}
+		if err == sms.ErrRouteBacklogged {
+			w.Header().Set("Retry-After", strconv.Itoa(int(smsRoute.Backlog().RetryAfter.Seconds())))
+			return StatusError{503, err}
+		}
 		return StatusError{500, err}
 	}
 
@@ -144,14 +235,16 @@ func SendSms(env *Env, w http.ResponseWriter, r *http.Request) error {
 // Healthz -
 func Healthz(env *Env, w http.ResponseWriter, r *http.Request) error {
 
-	tracer := global.Tracer(env.ServiceName)
-	span, _ := tracer.Start(r.Context(), "healthz")
-	defer span.Done()
+	_, span := utils.StartSpan(r.Context(), "healthz")
+	defer span.End()
 
 	msg := "ok"
 	statusCode := http.StatusOK
 	if !env.SMSServer.IsActive() {
 		msg = "failed"
+		if env.Queue != nil && !env.Queue.IsConnected() {
+			msg = "failed : queue is disconnected"
+		}
 		statusCode = http.StatusInternalServerError
 	}
 
@@ -161,3 +254,150 @@ func Healthz(env *Env, w http.ResponseWriter, r *http.Request) error {
 	return nil
 
 }
+
+// HealthzBacklog -
+func HealthzBacklog(env *Env, w http.ResponseWriter, r *http.Request) error {
+
+	_, span := utils.StartSpan(r.Context(), "healthzBacklog")
+	defer span.End()
+
+	backlog := make(map[string]sms.Backlog)
+	for _, smsRoute := range env.SMSServer.Routes() {
+		if smsRoute.CanQueue() {
+			backlog[smsRoute.ID()] = smsRoute.Backlog()
+		}
+	}
+
+	msg, err := json.Marshal(backlog)
+	if err != nil {
+		return StatusError{500, err}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(msg)
+	return nil
+
+}
+
+func routeFromPath(env *Env, r *http.Request) (*sms.Route, error) {
+	smsRoute := env.SMSServer.GetRoute(mux.Vars(r)["route_id"])
+	if smsRoute == nil {
+		return nil, StatusError{404, errors.New("No such route was found")}
+	}
+	return smsRoute, nil
+}
+
+func writeDeadLetters(w http.ResponseWriter, deadLetters []*sms.DeadLetter) error {
+
+	message, err := json.Marshal(deadLetters)
+	if err != nil {
+		return StatusError{500, err}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(message)
+	return nil
+}
+
+func replayDeadLetter(w http.ResponseWriter, replay func(id string) error, id string) error {
+
+	err := replay(id)
+	if err != nil {
+		if err == sms.ErrDeadLetterNotFound {
+			return StatusError{404, err}
+		}
+		return StatusError{500, err}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = w.Write([]byte("Queued"))
+	return nil
+}
+
+// ListWebhookDeadLetters -
+func ListWebhookDeadLetters(env *Env, w http.ResponseWriter, r *http.Request) error {
+
+	smsRoute, err := routeFromPath(env, r)
+	if err != nil {
+		return err
+	}
+
+	return writeDeadLetters(w, smsRoute.WebhookDeadLetters())
+}
+
+// ReplayWebhookDeadLetter -
+func ReplayWebhookDeadLetter(env *Env, w http.ResponseWriter, r *http.Request) error {
+
+	smsRoute, err := routeFromPath(env, r)
+	if err != nil {
+		return err
+	}
+
+	return replayDeadLetter(w, smsRoute.ReplayWebhookDeadLetter, mux.Vars(r)["id"])
+}
+
+// ListMessageDeadLetters -
+func ListMessageDeadLetters(env *Env, w http.ResponseWriter, r *http.Request) error {
+
+	smsRoute, err := routeFromPath(env, r)
+	if err != nil {
+		return err
+	}
+
+	return writeDeadLetters(w, smsRoute.MessageDeadLetters())
+}
+
+// ReplayMessageDeadLetter -
+func ReplayMessageDeadLetter(env *Env, w http.ResponseWriter, r *http.Request) error {
+
+	smsRoute, err := routeFromPath(env, r)
+	if err != nil {
+		return err
+	}
+
+	return replayDeadLetter(w, smsRoute.ReplayMessageDeadLetter, mux.Vars(r)["id"])
+}
+
+// CancelScheduledSms -
+func CancelScheduledSms(env *Env, w http.ResponseWriter, r *http.Request) error {
+
+	smsRoute, err := routeFromPath(env, r)
+	if err != nil {
+		return err
+	}
+
+	err = smsRoute.CancelScheduledMessage(mux.Vars(r)["message_id"])
+	if err != nil {
+		if err == sms.ErrScheduledMessageNotFound {
+			return StatusError{404, err}
+		}
+		return StatusError{500, err}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = w.Write([]byte("Cancelled"))
+	return nil
+}
+
+// RouteStatus -
+func RouteStatus(env *Env, w http.ResponseWriter, r *http.Request) error {
+
+	smsRoute, err := routeFromPath(env, r)
+	if err != nil {
+		return err
+	}
+
+	message, err := json.Marshal(smsRoute.Status())
+	if err != nil {
+		return StatusError{500, err}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(message)
+	return nil
+}
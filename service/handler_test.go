@@ -0,0 +1,154 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"antinvestor.com/service/routep/service/sms"
+	"antinvestor.com/service/routep/utils"
+	"github.com/fiorix/go-smpp/smpp/pdu"
+	"github.com/fiorix/go-smpp/smpp/pdu/pdufield"
+	"github.com/fiorix/go-smpp/smpp/pdu/pdutext"
+	"github.com/fiorix/go-smpp/smpp/smpptest"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const metricsRoutes = `active_routes:
+  - metrics_smsc
+metrics_smsc:
+  addresses: '%s'
+  user: %s
+  password: %s
+  bindType: tranceiver
+  operates_synchronously: 'True'
+  dlr_level: 3
+  sms_send_dlr_url: %s
+  sms_send_ack_url: %s
+  webhook_max_attempts: 1
+`
+
+// useRoutes runs the test from a directory holding the given routes.yaml
+func useRoutes(t *testing.T, routes string) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "routes.yaml"), []byte(routes), 0600))
+
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.NoError(t, os.Chdir(dir))
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+}
+
+func TestMetricsAreScraped(t *testing.T) {
+
+	smsc := smpptest.NewUnstartedServer()
+	smsc.Handler = func(c smpptest.Conn, p pdu.Body) {
+		if p.Header().ID != pdu.SubmitSMID {
+			return
+		}
+
+		resp := pdu.NewSubmitSMResp()
+		resp.Header().Seq = p.Header().Seq
+		_ = resp.Fields().Set(pdufield.MessageID, "0a1b2c")
+		_ = c.Write(resp)
+
+		dlr := pdu.NewDeliverSM()
+		_ = dlr.Fields().Set(pdufield.SourceAddr, p.Fields()[pdufield.DestinationAddr].String())
+		_ = dlr.Fields().Set(pdufield.DestinationAddr, p.Fields()[pdufield.SourceAddr].String())
+		_ = dlr.Fields().Set(pdufield.ShortMessage, pdutext.Raw("id:0a1b2c sub:001 dlvrd:001 submit date:2001021530 done date:2001021531 stat:DELIVRD err:000 text:"))
+		_ = c.Write(dlr)
+	}
+	smsc.Start()
+	defer smsc.Close()
+
+	webhooks := make(chan string, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		webhooks <- r.URL.Path
+	}))
+	defer webhook.Close()
+
+	useRoutes(t, fmt.Sprintf(metricsRoutes, smsc.Addr(), smpptest.DefaultUser, smpptest.DefaultPasswd,
+		webhook.URL+"/dlr", webhook.URL+"/ack"))
+
+	queue := utils.NewMemoryQueue()
+	defer queue.Close()
+
+	log := logrus.NewEntry(logrus.New())
+	smsServer, err := sms.NewServer(queue, log)
+	assert.NoError(t, err)
+
+	env := &Env{Queue: queue, Logger: log, SMSServer: smsServer}
+	server := httptest.NewServer(NewRouter(env))
+	defer server.Close()
+	defer smsServer.Stop(context.Background(), log)
+
+	assert.Eventually(t, func() bool {
+		resp, err := http.Get(server.URL + "/healthz")
+		if err != nil {
+			return false
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, 5*time.Second, 50*time.Millisecond, "the route never bound")
+
+	resp, err := http.PostForm(server.URL+"/", url.Values{
+		"from": {"22333"}, "to": {"254700000001"}, "data": {"Hello"}, "message_id": {"m1"}, "route_id": {"metrics_smsc"},
+	})
+	assert.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	select {
+	case path := <-webhooks:
+		assert.Equal(t, "/dlr", path)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the dlr never reached the webhook")
+	}
+
+	scrape := func() string {
+		resp, err := http.Get(server.URL + "/metrics")
+		if err != nil {
+			return ""
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	series := []string{
+		fmt.Sprintf(`routep_smpp_bound{route="metrics_smsc",subroute="%s"} 1`, smsc.Addr()),
+		fmt.Sprintf(`routep_smpp_submits_total{route="metrics_smsc",status="OK",subroute="%s"}`, smsc.Addr()),
+		fmt.Sprintf(`routep_smpp_submit_duration_seconds_count{route="metrics_smsc",subroute="%s"}`, smsc.Addr()),
+		`routep_dlrs_total{route="metrics_smsc",status="DELIVRD"}`,
+		`routep_dlr_status_total{route="metrics_smsc",status="delivered"}`,
+		`routep_webhook_attempts_total{event="dlr",route="metrics_smsc"}`,
+		`routep_webhook_duration_seconds_count{event="dlr",route="metrics_smsc"}`,
+		`routep_http_requests_total{handler="SendSms",method="POST",status="201"}`,
+	}
+
+	// The webhook attempt is counted once its response is back
+	var metrics string
+	assert.Eventually(t, func() bool {
+		metrics = scrape()
+		for _, s := range series {
+			if !strings.Contains(metrics, s) {
+				return false
+			}
+		}
+		return true
+	}, 2*time.Second, 50*time.Millisecond)
+
+	for _, s := range series {
+		assert.Contains(t, metrics, s)
+	}
+	assert.NotContains(t, metrics, `routep_webhook_failures_total{event="dlr",route="metrics_smsc"}`)
+}
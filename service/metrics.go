@@ -0,0 +1,46 @@
+package service
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "routep_http_requests_total",
+		Help: "HTTP requests handled by handler, method and response status.",
+	}, []string{"handler", "method", "status"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "routep_http_request_duration_seconds",
+		Help:    "Time taken to handle HTTP requests by handler.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"handler"})
+)
+
+// statusRecorder remembers the status a handler responded with
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Instrument counts and times the requests served by the handler
+func Instrument(inner http.Handler, name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		inner.ServeHTTP(recorder, r)
+
+		httpRequestsTotal.WithLabelValues(name, r.Method, strconv.Itoa(recorder.status)).Inc()
+		httpRequestDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	})
+}
@@ -2,15 +2,16 @@ package service
 
 import (
 	"antinvestor.com/service/routep/service/sms"
+	"antinvestor.com/service/routep/utils"
 	"context"
 	"fmt"
 	"github.com/gorilla/handlers"
-	"github.com/nats-io/stan.go"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/time/rate"
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -39,7 +40,7 @@ func (se StatusError) Status() int {
 
 // Env Context object supplied around the applications lifetime
 type Env struct {
-	Queue      stan.Conn
+	Queue      utils.Queue
 	Logger     *logrus.Entry
 	SMSServer  *sms.Server
 	ServiceName string
@@ -63,7 +64,10 @@ func limit(next http.Handler) http.Handler {
 //RunServer Starts a server and waits on it
 func RunServer(env *Env) {
 
-	waitDuration := time.Second * 15
+	waitDuration, err := time.ParseDuration(utils.GetEnv("SHUTDOWN_TIMEOUT", "25s"))
+	if err != nil {
+		env.Logger.Fatalf("Service stopping due to invalid SHUTDOWN_TIMEOUT : %v", err)
+	}
 
 	smsServer, err := sms.NewServer(env.Queue, env.Logger)
 	if err != nil {
@@ -88,29 +92,46 @@ func RunServer(env *Env) {
 
 		env.Logger.Infof("Service running on port : %v", env.ServerPort)
 
-		if err := srv.ListenAndServe(); err != nil {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			env.Logger.Fatalf("Service stopping due to error : %v", err)
 		}
 	}()
 
 	c := make(chan os.Signal, 1)
 	// We'll accept graceful shutdowns when quit via SIGINT (Ctrl+C)
-	// SIGKILL, SIGQUIT or SIGTERM (Ctrl+/) will not be caught.
-	signal.Notify(c, os.Interrupt)
+	// or SIGTERM which is how kubernetes stops pods.
+	// SIGKILL and SIGQUIT will not be caught.
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
 	// Block until we receive our signal.
-	<-c
+	sig := <-c
+	env.Logger.Infof("Service received %v, shutting down", sig)
 
 	// Create a deadline to wait for.
 	env2, cancel := context.WithTimeout(context.Background(), waitDuration)
 	defer cancel()
 	// Doesn't block if no connections, but will otherwise wait
 	// until the timeout deadline.
-	srv.Shutdown(env2)
+	err = srv.Shutdown(env2)
+	if err != nil {
+		env.Logger.WithError(err).Warn("http server did not shut down cleanly")
+	}
+
+	// Stops consuming, waits on in flight work within the same deadline then unbinds
+	smsServer.Stop(env2, env.Logger)
+
+	err = env.Queue.Close()
+	if err != nil {
+		env.Logger.WithError(err).Warn("queue did not close cleanly")
+	}
+
+	// Traces get a deadline of their own as draining may have used up the shutdown one
+	traceCtx, traceCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer traceCancel()
+	err = utils.ShutdownTracer(traceCtx)
+	if err != nil {
+		env.Logger.WithError(err).Warn("could not flush traces")
+	}
 
-	smsServer.Stop()
-	// Optionally, you could run srv.Shutdown in a goroutine and block on
-	// <-env.Done() if your application should wait for other services
-	// to finalize based on context cancellation.
 	env.Logger.Infof("Service shutting down at : %v", time.Now())
 }
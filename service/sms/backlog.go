@@ -0,0 +1,219 @@
+package sms
+
+import (
+	"antinvestor.com/service/routep/utils"
+	"encoding/json"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// ErrRouteBacklogged is returned when a route has more messages waiting to be
+// sent than it is configured to hold
+var ErrRouteBacklogged = errors.New("route has too many messages waiting to be sent, retry later")
+
+// Backlog is how many messages a route has published for sending that are
+// not yet acknowledged
+type Backlog struct {
+	Pending    int           `json:"pending"`
+	MaxBacklog int           `json:"max_backlog"`
+	RetryAfter time.Duration `json:"-"`
+}
+
+// IsFull is true once the pending messages reach the configured maximum
+func (b Backlog) IsFull() bool {
+	return b.MaxBacklog > 0 && b.Pending >= b.MaxBacklog
+}
+
+// backlogTracker follows a route's send lanes along with the acks and dead
+// letters that settle them, keyed on the QueueID the router gives each queued
+// message. Every replica observes the subjects itself so the count covers
+// messages published and sent by all of them, on start it replays the window
+// so messages still pending from before a restart are counted. A message only
+// leaves the backlog once it is acked or dead lettered, however long that takes.
+type backlogTracker struct {
+	routeID    string
+	queue      utils.Queue
+	log        *logrus.Entry
+	window     time.Duration
+	maxBacklog int
+	retryAfter time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*pendingMessage
+	settled map[string]time.Time
+
+	subscriptions []utils.Subscription
+	exitSignal    chan struct{}
+}
+
+func newBacklogTracker(queue utils.Queue, log *logrus.Entry, routeID string, window time.Duration,
+	maxBacklog int, retryAfter time.Duration) *backlogTracker {
+	return &backlogTracker{
+		routeID:    routeID,
+		queue:      queue,
+		log:        log,
+		window:     window,
+		maxBacklog: maxBacklog,
+		retryAfter: retryAfter,
+		pending:    make(map[string]*pendingMessage),
+		settled:    make(map[string]time.Time),
+		exitSignal: make(chan struct{}),
+	}
+}
+
+// Backlog reports the route's pending messages against its threshold
+func (t *backlogTracker) Backlog() Backlog {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return Backlog{Pending: len(t.pending), MaxBacklog: t.maxBacklog, RetryAfter: t.retryAfter}
+}
+
+type pendingMessage struct {
+	subject string
+}
+
+func (t *backlogTracker) published(subject string, queueID string) {
+	if queueID == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Acks can be observed ahead of the message when replaying the window
+	if _, ok := t.settled[queueID]; ok {
+		delete(t.settled, queueID)
+		return
+	}
+	if _, ok := t.pending[queueID]; ok {
+		return
+	}
+	t.pending[queueID] = &pendingMessage{subject: subject}
+	sendBacklog.WithLabelValues(t.routeID, subject).Inc()
+}
+
+func (t *backlogTracker) settle(queueID string) {
+	if queueID == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if pending, ok := t.pending[queueID]; ok {
+		delete(t.pending, queueID)
+		sendBacklog.WithLabelValues(t.routeID, pending.subject).Dec()
+		return
+	}
+	t.settled[queueID] = time.Now()
+}
+
+// evictExpired forgets settlements older than the window whose messages were
+// never seen, those messages are no longer replayed
+func (t *backlogTracker) evictExpired() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for queueID, seenAt := range t.settled {
+		if time.Since(seenAt) > t.window {
+			delete(t.settled, queueID)
+		}
+	}
+}
+
+func (t *backlogTracker) subscribe(subject string, handler func(data []byte) error) error {
+
+	subs, err := t.queue.Subscribe(subject, func(m utils.Msg) {
+		err := handler(m.Data())
+		if err != nil {
+			t.log.WithError(err).Warnf("error decoding backlog event on %s : [ %v ] hence ignoring it", subject, utils.RedactPayload(m.Data()))
+		}
+	}, utils.StartAtTimeDelta(t.window))
+	if err != nil {
+		return err
+	}
+
+	t.subscriptions = append(t.subscriptions, subs)
+	return nil
+}
+
+func (t *backlogTracker) start() error {
+
+	for _, priority := range Priorities {
+		subject := GetSmsSendPriorityQueueName(t.routeID, priority)
+		err := t.subscribe(subject, func(data []byte) error {
+			message := &SMS{}
+			err := json.Unmarshal(data, message)
+			if err != nil {
+				return err
+			}
+			t.published(subject, message.QueueID)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err := t.subscribe(GetSmsSendAckQueueName(t.routeID), func(data []byte) error {
+		ack := &ACK{}
+		err := json.Unmarshal(data, ack)
+		if err != nil {
+			return err
+		}
+		t.settle(ack.QueueID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = t.subscribe(GetSmsDeadLetterQueueName(t.routeID), func(data []byte) error {
+		deadLetter := &DeadLetter{}
+		err := json.Unmarshal(data, deadLetter)
+		if err != nil {
+			return err
+		}
+		if deadLetter.Event != messageEventSend {
+			return nil
+		}
+
+		// Undecodable messages can't be told apart and are left to age out
+		message := &SMS{}
+		if json.Unmarshal(deadLetter.Payload, message) == nil {
+			t.settle(message.QueueID)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				t.evictExpired()
+			case <-t.exitSignal:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (t *backlogTracker) stop() {
+	close(t.exitSignal)
+	for _, subscription := range t.subscriptions {
+		err := subscription.Close()
+		if err != nil {
+			t.log.WithError(err).Warn("failed to close backlog subscription")
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package sms
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"antinvestor.com/service/routep/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBacklogCountsPublishedMessagesUntilAcked(t *testing.T) {
+
+	queue := utils.NewMemoryQueue()
+	defer queue.Close()
+
+	tracker := newBacklogTracker(queue, logrus.NewEntry(logrus.New()), "test_smsc", time.Hour, 2, time.Minute)
+	assert.NoError(t, tracker.start())
+	defer tracker.stop()
+
+	publish := func(subject string, payload interface{}) {
+		data, err := json.Marshal(payload)
+		assert.NoError(t, err)
+		assert.NoError(t, queue.Publish(subject, data))
+	}
+
+	publish(GetSmsSendPriorityQueueName("test_smsc", PriorityNormal), &SMS{MessageID: "client-1", QueueID: "one"})
+	publish(GetSmsSendPriorityQueueName("test_smsc", PriorityHigh), &SMS{MessageID: "client-1", QueueID: "two"})
+
+	assert.Eventually(t, func() bool { return tracker.Backlog().Pending == 2 }, time.Second, 10*time.Millisecond)
+	assert.True(t, tracker.Backlog().IsFull())
+
+	publish(GetSmsSendAckQueueName("test_smsc"), &ACK{MessageID: "client-1", QueueID: "one", SmscStatus: AckStatusSubmitted})
+
+	assert.Eventually(t, func() bool { return tracker.Backlog().Pending == 1 }, time.Second, 10*time.Millisecond)
+	assert.False(t, tracker.Backlog().IsFull())
+}
+
+func TestBacklogKeepsStaleMessagesPending(t *testing.T) {
+
+	queue := utils.NewMemoryQueue()
+	defer queue.Close()
+
+	tracker := newBacklogTracker(queue, logrus.NewEntry(logrus.New()), "test_smsc", time.Millisecond, 1, time.Minute)
+	tracker.published(GetSmsSendQueueName("test_smsc"), "one")
+	tracker.settle("unseen")
+
+	time.Sleep(5 * time.Millisecond)
+	tracker.evictExpired()
+
+	assert.True(t, tracker.Backlog().IsFull(), "messages past the window are still waiting to be sent")
+	assert.Empty(t, tracker.settled)
+
+	tracker.settle("one")
+	assert.Equal(t, 0, tracker.Backlog().Pending)
+}
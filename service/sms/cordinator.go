@@ -1,17 +1,37 @@
 package sms
 
 import (
+	"antinvestor.com/service/routep/pdujournal"
+	"antinvestor.com/service/routep/utils"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/nats-io/stan.go"
+	"github.com/nats-io/nuid"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"math/rand"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
+const (
+	messageEventSend    = "send"
+	messageEventAck     = "ack"
+	messageEventDLR     = "dlr"
+	messageEventReceive = "receive"
+)
+
+const (
+	AckStatusSubmitted  = "Submitted"
+	AckStatusSuppressed = "Suppressed"
+	AckStatusExpired    = "Expired"
+	AckStatusScheduled  = "Scheduled"
+)
+
 type DLR struct {
 	From       string `json:"from"`
 	To         string `json:"to"`
@@ -19,6 +39,9 @@ type DLR struct {
 	SmscID     string `json:"smsc_id"`
 	SmscStatus string `json:"smsc_status"`
 
+	Status        DeliveryStatus `json:"status"`
+	ErrorCategory ErrorCategory  `json:"error_category"`
+
 	Sub           string `json:"sub,omitempty"`
 	Dlvrd         string `json:"dlvrd,omitempty"`
 	SubmittedDate string `json:"submitted_date,omitempty"`
@@ -26,6 +49,16 @@ type DLR struct {
 	Text          string `json:"text,omitempty"`
 	Err           string `json:"err,omitempty"`
 	SmscExtra     string `json:"smsc_extra"`
+
+	MessageID string            `json:"message_id,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	DLRURL    string            `json:"dlr_url,omitempty"`
+
+	TraceContext map[string]string `json:"trace_context,omitempty"`
+}
+
+func (d *DLR) logFields() logrus.Fields {
+	return logrus.Fields{"message_id": d.MessageID, "route_id": d.RouteID, "smsc_id": d.SmscID}
 }
 
 type ACK struct {
@@ -35,6 +68,16 @@ type ACK struct {
 	RouteID    string `json:"route_id"`
 	SmscID     string `json:"smsc_id"`
 	SmscStatus string `json:"smsc_status"`
+	AckURL     string `json:"ack_url,omitempty"`
+
+	// QueueID is the QueueID of the message being acknowledged
+	QueueID string `json:"queue_id,omitempty"`
+
+	TraceContext map[string]string `json:"trace_context,omitempty"`
+}
+
+func (a *ACK) logFields() logrus.Fields {
+	return logrus.Fields{"message_id": a.MessageID, "route_id": a.RouteID, "smsc_id": a.SmscID}
 }
 
 type SMS struct {
@@ -46,12 +89,49 @@ type SMS struct {
 	SmscID     string `json:"smsc_id,omitempty"`
 	SmscStatus string `json:"smsc_status,omitempty"`
 	SmscExtra  string `json:"smsc_extra,omitempty"`
+
+	Metadata map[string]string `json:"metadata,omitempty"`
+	AckURL   string            `json:"ack_url,omitempty"`
+	DLRURL   string            `json:"dlr_url,omitempty"`
+
+	Transactional bool       `json:"transactional,omitempty"`
+	Keyword       string     `json:"keyword,omitempty"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	Priority      string     `json:"priority,omitempty"`
+	SendAt        *time.Time `json:"send_at,omitempty"`
+
+	// QueueID is assigned by the router each time it queues the message for
+	// sending, unlike the client's MessageID it is never shared by two messages
+	QueueID string `json:"queue_id,omitempty"`
+
+	TraceContext map[string]string `json:"trace_context,omitempty"`
+}
+
+// logFields are the fields that tie log lines to the message
+func (s *SMS) logFields() logrus.Fields {
+	return logrus.Fields{"message_id": s.MessageID, "route_id": s.RouteID, "smsc_id": s.SmscID}
+}
+
+// IsExpired is true once a message is past the time it was meant to be sent by
+func (s *SMS) IsExpired() bool {
+	return s.ExpiresAt != nil && time.Now().After(*s.ExpiresAt)
 }
 
 type Route struct {
-	id        string
-	queue     stan.Conn
-	subRoutes []SubRoute
+	id           string
+	messageTTL   time.Duration
+	queue        utils.Queue
+	receipts     *receiptStore
+	suppressions *suppressionList
+	scheduler    *messageScheduler
+	journal      *pdujournal.Journal
+	backlog      *backlogTracker
+	subRoutes    []SubRoute
+
+	webhookClient *webhookClient
+
+	webhookDeadLetters *deadLetterBox
+	messageDeadLetters *deadLetterBox
 }
 
 func (r *Route) ID() string {
@@ -61,10 +141,11 @@ func (r *Route) ID() string {
 // IsActive
 //only returns true immediately after initialization if it is working asynchronousl otherwise
 //it activates when one of its subroutes becomes active
+//queued routes go inactive while the queue is unreachable
 func (r *Route) IsActive() bool {
 
 	if r.CanQueue() {
-		return true
+		return r.queue.IsConnected()
 	} else {
 
 		for _, subRoute := range r.subRoutes {
@@ -87,14 +168,84 @@ func (r *Route) CanQueue() bool {
 
 func (r *Route) SendMOMessage(message *SMS) (*ACK, error) {
 
+	if !message.Transactional && r.suppressions.IsSuppressed(message.From, message.To) {
+
+		if r.suppressions.action == suppressionActionReject {
+			return nil, ErrRecipientSuppressed
+		}
+
+		messageAck := &ACK{
+			From:       message.From,
+			To:         message.To,
+			MessageID:  message.MessageID,
+			RouteID:    message.RouteID,
+			SmscStatus: AckStatusSuppressed,
+			AckURL:     message.AckURL,
+
+			TraceContext: message.TraceContext,
+		}
+
+		// Queued routes ack dropped messages on the ack queue like sent ones so
+		// the ack webhook hears of them, otherwise the caller gets the ack back
+		if r.CanQueue() {
+			binAck, err := json.Marshal(messageAck)
+			if err != nil {
+				return nil, err
+			}
+
+			err = r.queue.Publish(GetSmsSendAckQueueName(r.ID()), binAck)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return messageAck, nil
+	}
+
+	if message.SendAt != nil && time.Now().Before(*message.SendAt) {
+
+		if !r.CanQueue() {
+			return nil, errors.New("can't schedule messages on a route that does not queue")
+		}
+
+		// The ttl of a scheduled message runs from when it is due
+		if message.ExpiresAt == nil && r.messageTTL > 0 {
+			expiresAt := message.SendAt.Add(r.messageTTL)
+			message.ExpiresAt = &expiresAt
+		}
+
+		err := r.scheduler.Schedule(message)
+		if err != nil {
+			return nil, err
+		}
+
+		return &ACK{
+			From:       message.From,
+			To:         message.To,
+			MessageID:  message.MessageID,
+			RouteID:    message.RouteID,
+			SmscStatus: AckStatusScheduled,
+			AckURL:     message.AckURL,
+		}, nil
+	}
+
 	if r.CanQueue() {
 
+		if r.backlog.Backlog().IsFull() {
+			return nil, ErrRouteBacklogged
+		}
+
+		if message.ExpiresAt == nil && r.messageTTL > 0 {
+			expiresAt := time.Now().Add(r.messageTTL)
+			message.ExpiresAt = &expiresAt
+		}
+
+		message.QueueID = nuid.Next()
 		binMessage, err := json.Marshal(message)
 		if err != nil {
 			return nil, err
 		}
 
-		err = r.queue.Publish(GetSmsSendQueueName(message.RouteID), binMessage)
+		err = r.queue.Publish(GetSmsSendPriorityQueueName(message.RouteID, message.Priority), binMessage)
 		if err != nil {
 			return nil, err
 		}
@@ -125,16 +276,125 @@ func (r *Route) SendMOMessage(message *SMS) (*ACK, error) {
 }
 
 func (r *Route) init(log *logrus.Entry) {
+	err := r.receipts.start()
+	if err != nil {
+		log.WithError(err).Warnf("could not replay receipts for route : %s", r.ID())
+	}
+
+	err = r.webhookDeadLetters.start()
+	if err != nil {
+		log.WithError(err).Warnf("could not replay webhook dead letters for route : %s", r.ID())
+	}
+
+	err = r.messageDeadLetters.start()
+	if err != nil {
+		log.WithError(err).Warnf("could not replay message dead letters for route : %s", r.ID())
+	}
+
+	err = r.suppressions.start()
+	if err != nil {
+		log.WithError(err).Warnf("could not replay suppressions for route : %s", r.ID())
+	}
+
+	if r.CanQueue() {
+		err = r.scheduler.start()
+		if err != nil {
+			log.WithError(err).Warnf("could not start the message scheduler for route : %s", r.ID())
+		}
+
+		err = r.backlog.start()
+		if err != nil {
+			log.WithError(err).Warnf("could not track the backlog for route : %s", r.ID())
+		}
+	}
+
 	for _, subRoute := range r.subRoutes {
 		log.Infof(" Initiating sub route : %s ", r.ID())
 		go subRoute.Init()
 	}
 }
 
+// stopConsuming stops taking messages off the queue for sending or delivery
+func (r *Route) stopConsuming() {
+	r.scheduler.stop()
+	for _, subRoute := range r.subRoutes {
+		subRoute.StopConsuming()
+	}
+}
+
+// drain waits for the work the route already took on to finish
+func (r *Route) drain(ctx context.Context, log *logrus.Entry) {
+	for _, subRoute := range r.subRoutes {
+		err := subRoute.Drain(ctx)
+		if err != nil {
+			log.WithError(err).Warnf("stopping route : %s before in flight work finished", r.ID())
+		}
+	}
+}
+
 func (r *Route) Stop() {
 	for _, subRoute := range r.subRoutes {
 		subRoute.Stop()
 	}
+	r.receipts.stop()
+	r.webhookDeadLetters.stop()
+	r.messageDeadLetters.stop()
+	r.suppressions.stop()
+	r.backlog.stop()
+
+	// Every record was written through already so there is nothing to lose on close
+	_ = r.journal.Close()
+}
+
+// Backlog is how many messages are waiting to be sent on the route
+func (r *Route) Backlog() Backlog {
+	return r.backlog.Backlog()
+}
+
+// Status reports the state of the route's binds and its recent traffic
+func (r *Route) Status() RouteStatus {
+
+	status := RouteStatus{RouteID: r.ID(), Active: r.IsActive()}
+	for _, subRoute := range r.subRoutes {
+		status.SubRoutes = append(status.SubRoutes, subRoute.Status())
+	}
+	status.Windows = routeWindows(status.SubRoutes)
+
+	if r.CanQueue() {
+		backlog := r.Backlog()
+		status.Backlog = &backlog
+	}
+	return status
+}
+
+// AllowsCallbackURL checks a per message ack or dlr url against the hosts the route trusts
+func (r *Route) AllowsCallbackURL(callbackUrl *url.URL) bool {
+	return r.webhookClient.trusts(callbackUrl)
+}
+
+// CancelScheduledMessage stops a message scheduled for later from being sent
+func (r *Route) CancelScheduledMessage(messageID string) error {
+	return r.scheduler.Cancel(messageID)
+}
+
+// WebhookDeadLetters lists the webhook events that exhausted their delivery attempts
+func (r *Route) WebhookDeadLetters() []*DeadLetter {
+	return r.webhookDeadLetters.List()
+}
+
+// ReplayWebhookDeadLetter queues a dead lettered webhook event for delivery again
+func (r *Route) ReplayWebhookDeadLetter(id string) error {
+	return r.webhookDeadLetters.Replay(id)
+}
+
+// MessageDeadLetters lists the queued messages that could not be decoded or kept failing
+func (r *Route) MessageDeadLetters() []*DeadLetter {
+	return r.messageDeadLetters.List()
+}
+
+// ReplayMessageDeadLetter requeues a dead lettered message on the subject it came from
+func (r *Route) ReplayMessageDeadLetter(id string) error {
+	return r.messageDeadLetters.Replay(id)
 }
 
 type SubRoute interface {
@@ -143,14 +403,23 @@ type SubRoute interface {
 	IsActive() bool
 	CanQueue() bool
 	SendMOMessage(message *SMS) (*ACK, error)
+	StopConsuming()
+	Drain(ctx context.Context) error
 	Stop()
+	Status() SubRouteStatus
 }
 
 type Server struct {
+	queue           utils.Queue
 	availableRoutes map[string]*Route
 }
 
+// IsActive is true while the queue is reachable and at least one route is active
 func (s *Server) IsActive() bool {
+	if s.queue != nil && !s.queue.IsConnected() {
+		return false
+	}
+
 	for _, route := range s.availableRoutes {
 		if route.IsActive() {
 			return true
@@ -160,6 +429,18 @@ func (s *Server) IsActive() bool {
 	return false
 }
 
+// Routes lists the available routes ordered by id
+func (s *Server) Routes() []*Route {
+	routes := make([]*Route, 0, len(s.availableRoutes))
+	for _, route := range s.availableRoutes {
+		routes = append(routes, route)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].ID() < routes[j].ID()
+	})
+	return routes
+}
+
 func (s *Server) GetRoute(id string) *Route {
 	if route, ok := s.availableRoutes[id]; ok {
 		return route
@@ -168,13 +449,21 @@ func (s *Server) GetRoute(id string) *Route {
 	}
 }
 
-func (s *Server) Stop() {
+// Stop closes the queue subscriptions of every route, waits for in flight
+// submits and webhook posts until the context expires then unbinds from the smscs
+func (s *Server) Stop(ctx context.Context, log *logrus.Entry) {
+	for _, route := range s.availableRoutes {
+		route.stopConsuming()
+	}
+	for _, route := range s.availableRoutes {
+		route.drain(ctx, log)
+	}
 	for _, route := range s.availableRoutes {
 		route.Stop()
 	}
 }
 
-func (s *Server) newRoute(queue stan.Conn, log *logrus.Entry, routeID string) error {
+func (s *Server) newRoute(queue utils.Queue, log *logrus.Entry, routeID string) error {
 
 	if s.availableRoutes[routeID] != nil {
 		return nil
@@ -185,22 +474,140 @@ func (s *Server) newRoute(queue stan.Conn, log *logrus.Entry, routeID string) er
 	hostAddresses := GetSetting(fmt.Sprintf("%s.addresses", routeID), "")
 	hostAddressSlice := strings.Split(hostAddresses, ",")
 
+	routeLog := log.WithField("route_id", routeID)
+
+	receiptTTL, err := time.ParseDuration(GetSetting(fmt.Sprintf("%s.receipt_ttl", routeID), "72h"))
+	if err != nil {
+		return err
+	}
+	receipts := newReceiptStore(queue, routeLog, routeID, receiptTTL)
+	inboundRules, err := loadInboundRules(routeID)
+	if err != nil {
+		return err
+	}
+	var inboundRuleUrls []string
+	for _, rule := range inboundRules {
+		inboundRuleUrls = append(inboundRuleUrls, rule.URL)
+	}
+	webhookClient, err := newWebhookClient(routeID, inboundRuleUrls...)
+	if err != nil {
+		return err
+	}
+	deadLetterRetention, err := time.ParseDuration(GetSetting(fmt.Sprintf("%s.dead_letter_retention", routeID), "168h"))
+	if err != nil {
+		return err
+	}
+	webhookDeadLetters := newDeadLetterBox(queue, routeLog, GetWebhookDeadLetterQueueName(routeID), deadLetterRetention)
+	messageDeadLetters := newDeadLetterBox(queue, routeLog, GetSmsDeadLetterQueueName(routeID), deadLetterRetention)
+	suppressions, err := newSuppressionList(queue, routeLog, routeID)
+	if err != nil {
+		return err
+	}
+	dlrStatuses, err := loadDLRStatusTable(routeID)
+	if err != nil {
+		return err
+	}
+
+	// A zero ttl lets queued messages wait for as long as it takes to send them
+	messageTTL, err := time.ParseDuration(GetSetting(fmt.Sprintf("%s.message_ttl", routeID), "0s"))
+	if err != nil {
+		return err
+	}
+
+	scheduleCheckInterval, err := time.ParseDuration(GetSetting(fmt.Sprintf("%s.schedule_check_interval", routeID), "30s"))
+	if err != nil {
+		return err
+	}
+	scheduleMaxPending, err := strconv.Atoi(GetSetting(fmt.Sprintf("%s.schedule_max_pending", routeID), "10000"))
+	if err != nil {
+		return err
+	}
+	scheduleMaxAhead, err := time.ParseDuration(GetSetting(fmt.Sprintf("%s.schedule_max_ahead", routeID), "720h"))
+	if err != nil {
+		return err
+	}
+
+	// A zero max backlog accepts messages however far behind the route is
+	maxBacklog, err := strconv.Atoi(GetSetting(fmt.Sprintf("%s.max_backlog", routeID), "0"))
+	if err != nil {
+		return err
+	}
+	backlogWindow, err := time.ParseDuration(GetSetting(fmt.Sprintf("%s.backlog_window", routeID), "24h"))
+	if err != nil {
+		return err
+	}
+	backlogRetryAfter, err := time.ParseDuration(GetSetting(fmt.Sprintf("%s.backlog_retry_after", routeID), "30s"))
+	if err != nil {
+		return err
+	}
+
+	// Journaling is off unless a file to record pdus to is configured
+	var journal *pdujournal.Journal
+	if journalFile := GetSetting(fmt.Sprintf("%s.pdu_journal_file", routeID), ""); journalFile != "" {
+		options := pdujournal.Options{File: journalFile}
+		for setting, value := range map[string]*int{
+			"pdu_journal_max_size_mb":  &options.MaxSizeMB,
+			"pdu_journal_max_backups":  &options.MaxBackups,
+			"pdu_journal_max_age_days": &options.MaxAgeDays,
+		} {
+			*value, err = strconv.Atoi(GetSetting(fmt.Sprintf("%s.%s", routeID, setting), "0"))
+			if err != nil {
+				return err
+			}
+		}
+		journal = pdujournal.New(options)
+		routeLog.Infof("recording pdus to : %s", journalFile)
+	}
+
 	for _, hostAddress := range hostAddressSlice {
 
+		workCtx, cancelWork := context.WithCancel(context.Background())
 		smppRoute := SmppRoute{
 			id:             routeID,
 			queue:          queue,
-			log:            log.WithField("SubRoute ID", routeID),
+			receipts:       receipts,
+			suppressions:   suppressions,
+			inboundRules:   inboundRules,
+			dlrStatuses:    dlrStatuses,
+
+			webhookClient:      webhookClient,
+			webhookDeadLetters: webhookDeadLetters,
+			messageDeadLetters: messageDeadLetters,
+			journal:            journal,
+			stats:              newRouteStats(),
+			log:            routeLog.WithField("subroute", hostAddress),
 			settingAddress: hostAddress,
 			active:         false,
 			exitSignal:     make(chan int, 1),
+			stopping:       make(chan struct{}),
+			workCtx:        workCtx,
+			cancelWork:     cancelWork,
 		}
 
 		subRouteSlice = append(subRouteSlice, &smppRoute)
 
 	}
 
-	s.availableRoutes[routeID] = &Route{routeID, queue, subRouteSlice}
+	route := &Route{
+		id:                 routeID,
+		messageTTL:         messageTTL,
+		queue:              queue,
+		receipts:           receipts,
+		suppressions:       suppressions,
+		subRoutes:          subRouteSlice,
+		webhookDeadLetters: webhookDeadLetters,
+		messageDeadLetters: messageDeadLetters,
+		webhookClient:      webhookClient,
+		journal:            journal,
+		backlog: newBacklogTracker(queue, routeLog, routeID, backlogWindow,
+			maxBacklog, backlogRetryAfter),
+	}
+	route.scheduler = newMessageScheduler(queue, routeLog, routeID, messageDeadLetters,
+		scheduleCheckInterval, scheduleMaxPending, scheduleMaxAhead, func(message *SMS) error {
+			_, err := route.SendMOMessage(message)
+			return err
+		})
+	s.availableRoutes[routeID] = route
 
 	return nil
 }
@@ -218,12 +625,36 @@ func GetSmsReceiveQueueName(routeID string) string {
 func GetSmsSendDLRQueueName(routeID string) string {
 	return fmt.Sprintf("%s.message.dlr", routeID)
 }
+func GetSmsReceiptQueueName(routeID string) string {
+	return fmt.Sprintf("%s.message.receipt", routeID)
+}
+func GetSmsScheduleQueueName(routeID string) string {
+	return fmt.Sprintf("%s.message.schedule", routeID)
+}
+func GetScheduleCancelQueueName(routeID string) string {
+	return fmt.Sprintf("%s.message.schedule.cancel", routeID)
+}
+func GetScheduleIndexQueueName(routeID string) string {
+	return fmt.Sprintf("%s.message.schedule.index", routeID)
+}
+func GetScheduleDelayQueueName(routeID string, stage int) string {
+	return fmt.Sprintf("%s.message.schedule.delay.%d", routeID, stage)
+}
+func GetSuppressionQueueName(routeID string) string {
+	return fmt.Sprintf("%s.suppression", routeID)
+}
+func GetSmsDeadLetterQueueName(routeID string) string {
+	return fmt.Sprintf("%s.message.deadletter", routeID)
+}
+func GetWebhookDeadLetterQueueName(routeID string) string {
+	return fmt.Sprintf("%s.webhook.deadletter", routeID)
+}
 
 func GetQueueGroup(routeID string) string {
 	return fmt.Sprintf("smpp-%s", routeID)
 }
 
-func NewServer(queue stan.Conn, log *logrus.Entry) (*Server, error) {
+func NewServer(queue utils.Queue, log *logrus.Entry) (*Server, error) {
 
 	viper.SetConfigName("routes")
 	viper.AddConfigPath(".")
@@ -235,6 +666,7 @@ func NewServer(queue stan.Conn, log *logrus.Entry) (*Server, error) {
 	routes := viper.GetStringSlice("active_routes")
 
 	smsServer := Server{
+		queue:           queue,
 		availableRoutes: make(map[string]*Route, len(routes)),
 	}
 
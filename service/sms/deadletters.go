@@ -0,0 +1,184 @@
+package sms
+
+import (
+	"antinvestor.com/service/routep/utils"
+	"encoding/json"
+	"errors"
+	"github.com/nats-io/nuid"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrDeadLetterNotFound is returned when replaying an event that is not dead lettered
+var ErrDeadLetterNotFound = errors.New("dead letter was not found")
+
+// DeadLetter is an event the router gave up on along with why it did so.
+// Replaying it republishes the payload on the subject it originally came from.
+type DeadLetter struct {
+	ID        string    `json:"id"`
+	RouteID   string    `json:"route_id"`
+	Event     string    `json:"event"`
+	Subject   string    `json:"subject"`
+	URL       string    `json:"url,omitempty"`
+	Payload   []byte    `json:"payload"`
+	Error     string    `json:"error"`
+	Attempts  int       `json:"attempts"`
+	CreatedAt time.Time `json:"created_at"`
+	Replayed  bool      `json:"replayed,omitempty"`
+}
+
+// deadLetterBox publishes dead letters on a route subject and keeps an index
+// of the ones that have not been replayed. Every replica replays the subject on
+// start so listing and replaying works from any of them. Dead letters older
+// than the retention are dropped from the index.
+type deadLetterBox struct {
+	subject   string
+	retention time.Duration
+	queue     utils.Queue
+	log       *logrus.Entry
+
+	mu          sync.RWMutex
+	deadLetters map[string]*DeadLetter
+
+	subscription utils.Subscription
+	exitSignal   chan struct{}
+}
+
+func newDeadLetterBox(queue utils.Queue, log *logrus.Entry, subject string, retention time.Duration) *deadLetterBox {
+	return &deadLetterBox{
+		subject:     subject,
+		retention:   retention,
+		queue:       queue,
+		log:         log,
+		deadLetters: make(map[string]*DeadLetter),
+		exitSignal:  make(chan struct{}),
+	}
+}
+
+// Add dead letters an event
+func (b *deadLetterBox) Add(deadLetter *DeadLetter) error {
+
+	deadLetter.ID = nuid.Next()
+	deadLetter.CreatedAt = time.Now()
+
+	return b.publish(deadLetter)
+}
+
+// List returns the dead letters not yet replayed, oldest first
+func (b *deadLetterBox) List() []*DeadLetter {
+
+	b.mu.RLock()
+	deadLetters := make([]*DeadLetter, 0, len(b.deadLetters))
+	for _, deadLetter := range b.deadLetters {
+		deadLetters = append(deadLetters, deadLetter)
+	}
+	b.mu.RUnlock()
+
+	sort.Slice(deadLetters, func(i, j int) bool {
+		return deadLetters[i].CreatedAt.Before(deadLetters[j].CreatedAt)
+	})
+	return deadLetters
+}
+
+// Replay republishes a dead lettered event on its original subject
+func (b *deadLetterBox) Replay(id string) error {
+
+	b.mu.RLock()
+	deadLetter, ok := b.deadLetters[id]
+	b.mu.RUnlock()
+	if !ok {
+		return ErrDeadLetterNotFound
+	}
+
+	err := b.queue.Publish(deadLetter.Subject, deadLetter.Payload)
+	if err != nil {
+		return err
+	}
+
+	return b.publish(&DeadLetter{ID: id, RouteID: deadLetter.RouteID, Replayed: true, CreatedAt: time.Now()})
+}
+
+func (b *deadLetterBox) publish(deadLetter *DeadLetter) error {
+
+	binDeadLetter, err := json.Marshal(deadLetter)
+	if err != nil {
+		return err
+	}
+
+	err = b.queue.Publish(b.subject, binDeadLetter)
+	if err != nil {
+		return err
+	}
+
+	b.index(deadLetter)
+	return nil
+}
+
+func (b *deadLetterBox) index(deadLetter *DeadLetter) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if deadLetter.Replayed || time.Since(deadLetter.CreatedAt) > b.retention {
+		delete(b.deadLetters, deadLetter.ID)
+	} else {
+		b.deadLetters[deadLetter.ID] = deadLetter
+	}
+}
+
+func (b *deadLetterBox) evictExpired() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for id, deadLetter := range b.deadLetters {
+		if time.Since(deadLetter.CreatedAt) > b.retention {
+			delete(b.deadLetters, id)
+		}
+	}
+}
+
+func (b *deadLetterBox) start() error {
+
+	// Every replica replays the dead letters still within the retention
+	subs, err := b.queue.Subscribe(b.subject, func(m utils.Msg) {
+
+		deadLetter := &DeadLetter{}
+		err := json.Unmarshal(m.Data(), deadLetter)
+		if err != nil {
+			b.log.WithError(err).Warnf("error decoding dead letter : [ %v ] hence ignoring it", utils.RedactPayload(m.Data()))
+			return
+		}
+		b.index(deadLetter)
+
+	}, utils.StartAtTimeDelta(b.retention))
+	if err != nil {
+		return err
+	}
+	b.subscription = subs
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				b.evictExpired()
+			case <-b.exitSignal:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (b *deadLetterBox) stop() {
+	close(b.exitSignal)
+	if b.subscription != nil {
+		err := b.subscription.Close()
+		if err != nil {
+			b.log.WithError(err).Warn("failed to close dead letter subscription")
+		}
+	}
+}
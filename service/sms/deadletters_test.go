@@ -0,0 +1,53 @@
+package sms
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"antinvestor.com/service/routep/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeadLettersAreDroppedOnceReplayedOrPastRetention(t *testing.T) {
+
+	queue := utils.NewMemoryQueue()
+	defer queue.Close()
+
+	log := logrus.NewEntry(logrus.New())
+	subject := GetWebhookDeadLetterQueueName("test_smsc")
+	box := newDeadLetterBox(queue, log, subject, time.Hour)
+
+	assert.NoError(t, box.Add(&DeadLetter{RouteID: "test_smsc", Event: webhookEventDLR, Subject: "test_smsc.replayed", Payload: []byte(`{}`)}))
+	assert.NoError(t, box.Add(&DeadLetter{RouteID: "test_smsc", Event: webhookEventAck, Subject: "test_smsc.kept", Payload: []byte(`{}`)}))
+
+	expired, err := json.Marshal(&DeadLetter{ID: "expired", RouteID: "test_smsc", CreatedAt: time.Now().Add(-2 * time.Hour)})
+	assert.NoError(t, err)
+	assert.NoError(t, queue.Publish(subject, expired))
+
+	deadLetters := box.List()
+	if assert.Len(t, deadLetters, 2) {
+		assert.NoError(t, box.Replay(deadLetters[0].ID))
+	}
+	assert.ErrorIs(t, box.Replay("expired"), ErrDeadLetterNotFound)
+
+	// Another replica replaying the subject only holds what is still to be dealt with
+	replica := newDeadLetterBox(queue, log, subject, time.Hour)
+	assert.NoError(t, replica.start())
+	defer replica.stop()
+
+	assert.Eventually(t, func() bool {
+		deadLetters := replica.List()
+		return len(deadLetters) == 1 && deadLetters[0].Subject == "test_smsc.kept"
+	}, 2*time.Second, 10*time.Millisecond)
+
+	replica.mu.Lock()
+	for _, deadLetter := range replica.deadLetters {
+		deadLetter.CreatedAt = time.Now().Add(-2 * time.Hour)
+	}
+	replica.mu.Unlock()
+
+	replica.evictExpired()
+	assert.Empty(t, replica.List())
+}
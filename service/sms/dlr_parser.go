@@ -0,0 +1,149 @@
+package sms
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/fiorix/go-smpp/smpp/pdu/pdufield"
+	"github.com/fiorix/go-smpp/smpp/pdu/pdutlv"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// dlrKeyPattern finds the keys of the smpp 3.4 receipt format, carriers vary
+// the case, spacing and order of the keys and leave some of them out
+var dlrKeyPattern = regexp.MustCompile(`(?i)\b(id|sub|dlvrd|submit[ _]?date|done[ _]?date|stat|err|text)\s*:`)
+
+// dlrMessageStates are the names of the message_state tlv values, they are
+// the same as the stat values of the receipt text
+var dlrMessageStates = map[byte]string{
+	1: "ENROUTE",
+	2: "DELIVRD",
+	3: "EXPIRED",
+	4: "DELETED",
+	5: "UNDELIV",
+	6: "ACCEPTD",
+	7: "UNKNOWN",
+	8: "REJECTD",
+}
+
+// dlrDateLayouts are the date formats carriers put in receipts by their length
+var dlrDateLayouts = map[int]string{
+	10: "0601021504",
+	12: "060102150405",
+	14: "20060102150405",
+}
+
+// parseDLR reads a delivery receipt out of a deliver_sm. Values carried in
+// tlvs are preferred over those in the receipt text and receipt dates are
+// read in the route's timezone.
+func parseDLR(fields pdufield.Map, tlvs pdutlv.Map, location *time.Location) *DLR {
+
+	dlrText := fieldString(fields, pdufield.ShortMessage)
+
+	dlr := &DLR{
+		From:      fieldString(fields, pdufield.SourceAddr),
+		To:        fieldString(fields, pdufield.DestinationAddr),
+		SmscExtra: dlrText,
+	}
+
+	values := parseDLRText(dlrText)
+	dlr.SmscID = values["id"]
+	dlr.Sub = values["sub"]
+	dlr.Dlvrd = values["dlvrd"]
+	dlr.SubmittedDate = parseDLRDate(values["submitdate"], location)
+	dlr.DoneDate = parseDLRDate(values["donedate"], location)
+	dlr.SmscStatus = strings.ToUpper(values["stat"])
+	dlr.Err = values["err"]
+	dlr.Text = values["text"]
+
+	if id := tlvString(tlvs, pdutlv.TagReceiptedMessageID); id != "" {
+		dlr.SmscID = id
+	}
+
+	if state := tlvBytes(tlvs, pdutlv.TagMessageStateOption); len(state) == 1 {
+		if stat, ok := dlrMessageStates[state[0]]; ok {
+			dlr.SmscStatus = stat
+		}
+	}
+
+	// network_error_code is the network type followed by a two octet error code
+	if networkError := tlvBytes(tlvs, pdutlv.TagNetworkErrorCode); len(networkError) == 3 {
+		dlr.Err = fmt.Sprintf("%03d", binary.BigEndian.Uint16(networkError[1:]))
+	}
+
+	return dlr
+}
+
+// parseDLRText splits receipt text into its values by key. A value runs up to
+// the next key that has not been seen yet so the free text of a receipt can
+// contain things that look like keys.
+func parseDLRText(dlrText string) map[string]string {
+
+	values := make(map[string]string)
+
+	var key string
+	var start int
+	for _, match := range dlrKeyPattern.FindAllStringSubmatchIndex(dlrText, -1) {
+
+		name := normalizeDLRKey(dlrText[match[2]:match[3]])
+		if _, seen := values[name]; seen || name == key {
+			continue
+		}
+
+		if key != "" {
+			values[key] = strings.TrimSpace(dlrText[start:match[0]])
+		}
+		key, start = name, match[1]
+	}
+
+	if key != "" {
+		values[key] = strings.TrimSpace(dlrText[start:])
+	}
+
+	return values
+}
+
+func normalizeDLRKey(key string) string {
+	return strings.NewReplacer(" ", "", "_", "").Replace(strings.ToLower(key))
+}
+
+// parseDLRDate converts a receipt date to RFC3339, dates that can't be read
+// are passed on as they are
+func parseDLRDate(value string, location *time.Location) string {
+
+	layout, ok := dlrDateLayouts[len(value)]
+	if !ok {
+		return value
+	}
+
+	if location == nil {
+		location = time.UTC
+	}
+
+	date, err := time.ParseInLocation(layout, value, location)
+	if err != nil {
+		return value
+	}
+	return date.Format(time.RFC3339)
+}
+
+func fieldString(fields pdufield.Map, name pdufield.Name) string {
+	field, ok := fields[name]
+	if !ok || field == nil {
+		return ""
+	}
+	return field.String()
+}
+
+func tlvBytes(tlvs pdutlv.Map, tag pdutlv.Tag) []byte {
+	field, ok := tlvs[tag]
+	if !ok || field == nil {
+		return nil
+	}
+	return field.Bytes()
+}
+
+func tlvString(tlvs pdutlv.Map, tag pdutlv.Tag) string {
+	return strings.TrimRight(string(tlvBytes(tlvs, tag)), "\x00")
+}
@@ -0,0 +1,79 @@
+package sms
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/fiorix/go-smpp/smpp/pdu/pdufield"
+	"github.com/fiorix/go-smpp/smpp/pdu/pdutext"
+	"github.com/fiorix/go-smpp/smpp/pdu/pdutlv"
+	"github.com/stretchr/testify/assert"
+)
+
+// dlrSample is a receipt from testdata/dlr_corpus.json with the dlr fields
+// it is expected to be parsed into
+type dlrSample struct {
+	Name     string            `json:"name"`
+	Text     string            `json:"text"`
+	TLVs     map[string]string `json:"tlvs"`
+	Timezone string            `json:"timezone"`
+	Expect   map[string]string `json:"expect"`
+}
+
+func TestDLRCorpusIsParsed(t *testing.T) {
+
+	corpus, err := os.ReadFile("testdata/dlr_corpus.json")
+	assert.NoError(t, err)
+
+	var samples []dlrSample
+	assert.NoError(t, json.Unmarshal(corpus, &samples))
+
+	for _, sample := range samples {
+		t.Run(sample.Name, func(t *testing.T) {
+
+			route := &SmppRoute{id: "test_smsc", settingDLRTimezone: time.UTC}
+			if sample.Timezone != "" {
+				route.settingDLRTimezone, err = time.LoadLocation(sample.Timezone)
+				assert.NoError(t, err)
+			}
+
+			fields := pdufield.Map{}
+			assert.NoError(t, fields.Set(pdufield.SourceAddr, "254700000001"))
+			assert.NoError(t, fields.Set(pdufield.DestinationAddr, "22333"))
+			assert.NoError(t, fields.Set(pdufield.ShortMessage, pdutext.Raw(sample.Text)))
+
+			tlvs := pdutlv.Map{}
+			for tagHex, valueHex := range sample.TLVs {
+				tag, err := strconv.ParseUint(tagHex, 16, 16)
+				assert.NoError(t, err)
+				value, err := hex.DecodeString(valueHex)
+				assert.NoError(t, err)
+				assert.NoError(t, tlvs.Set(pdutlv.Tag(tag), value))
+			}
+
+			encoded, err := json.Marshal(route.parseForDlr(fields, tlvs))
+			assert.NoError(t, err)
+			parsed := map[string]interface{}{}
+			assert.NoError(t, json.Unmarshal(encoded, &parsed))
+
+			for field, expected := range sample.Expect {
+				actual, _ := parsed[field].(string)
+				assert.Equal(t, expected, actual, field)
+			}
+			assert.Equal(t, "254700000001", parsed["from"])
+			assert.Equal(t, sample.Text, parsed["smsc_extra"])
+		})
+	}
+}
+
+func TestDLRWithoutFieldsIsParsed(t *testing.T) {
+
+	dlr := parseDLR(pdufield.Map{}, nil, nil)
+	assert.Empty(t, dlr.From)
+	assert.Empty(t, dlr.SmscID)
+	assert.Empty(t, dlr.SmscStatus)
+}
@@ -0,0 +1,156 @@
+package sms
+
+import (
+	"fmt"
+	"github.com/spf13/viper"
+	"strings"
+)
+
+// DeliveryStatus is the carrier independent outcome of a delivery receipt
+type DeliveryStatus string
+
+const (
+	DeliveryStatusDelivered DeliveryStatus = "delivered"
+	DeliveryStatusFailed    DeliveryStatus = "failed"
+	DeliveryStatusExpired   DeliveryStatus = "expired"
+	DeliveryStatusRejected  DeliveryStatus = "rejected"
+	DeliveryStatusUnknown   DeliveryStatus = "unknown"
+	DeliveryStatusEnroute   DeliveryStatus = "enroute"
+)
+
+// ErrorCategory groups the carrier error codes of a delivery receipt
+type ErrorCategory string
+
+const (
+	ErrorCategoryNone                  ErrorCategory = "none"
+	ErrorCategoryInvalidDestination    ErrorCategory = "invalid_destination"
+	ErrorCategorySubscriberUnavailable ErrorCategory = "subscriber_unavailable"
+	ErrorCategoryBlocked               ErrorCategory = "blocked"
+	ErrorCategoryNetwork               ErrorCategory = "network"
+	ErrorCategoryThrottled             ErrorCategory = "throttled"
+	ErrorCategoryExpired               ErrorCategory = "expired"
+	ErrorCategoryUnknown               ErrorCategory = "unknown"
+)
+
+var deliveryStatuses = map[DeliveryStatus]bool{
+	DeliveryStatusDelivered: true, DeliveryStatusFailed: true, DeliveryStatusExpired: true,
+	DeliveryStatusRejected: true, DeliveryStatusUnknown: true, DeliveryStatusEnroute: true,
+}
+
+var errorCategories = map[ErrorCategory]bool{
+	ErrorCategoryNone: true, ErrorCategoryInvalidDestination: true, ErrorCategorySubscriberUnavailable: true,
+	ErrorCategoryBlocked: true, ErrorCategoryNetwork: true, ErrorCategoryThrottled: true,
+	ErrorCategoryExpired: true, ErrorCategoryUnknown: true,
+}
+
+// defaultDLRStatuses are the stat values of the smpp 3.4 receipt format,
+// routes add their vendor variants to these through dlr_status_map
+var defaultDLRStatuses = map[string]DeliveryStatus{
+	"delivrd": DeliveryStatusDelivered,
+	"undeliv": DeliveryStatusFailed,
+	"deleted": DeliveryStatusFailed,
+	"expired": DeliveryStatusExpired,
+	"rejectd": DeliveryStatusRejected,
+	"unknown": DeliveryStatusUnknown,
+	"enroute": DeliveryStatusEnroute,
+	"acceptd": DeliveryStatusEnroute,
+}
+
+// dlrStatusTable maps a carrier's stat values and err codes onto the
+// canonical status and error category of a dlr
+type dlrStatusTable struct {
+	statuses map[string]DeliveryStatus
+	errors   map[string]ErrorCategory
+}
+
+func loadDLRStatusTable(routeID string) (*dlrStatusTable, error) {
+
+	var statuses map[string]string
+	err := viper.UnmarshalKey(fmt.Sprintf("%s.dlr_status_map", routeID), &statuses)
+	if err != nil {
+		return nil, err
+	}
+
+	var errorCodes map[string]string
+	err = viper.UnmarshalKey(fmt.Sprintf("%s.dlr_error_map", routeID), &errorCodes)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDLRStatusTable(routeID, statuses, errorCodes)
+}
+
+func newDLRStatusTable(routeID string, statuses map[string]string, errorCodes map[string]string) (*dlrStatusTable, error) {
+
+	table := &dlrStatusTable{
+		statuses: make(map[string]DeliveryStatus, len(defaultDLRStatuses)+len(statuses)),
+		errors:   make(map[string]ErrorCategory, len(errorCodes)),
+	}
+
+	for stat, status := range defaultDLRStatuses {
+		table.statuses[stat] = status
+	}
+
+	for stat, status := range statuses {
+		if !deliveryStatuses[DeliveryStatus(status)] {
+			return nil, fmt.Errorf("dlr status map of route %s maps %s onto unknown status %s", routeID, stat, status)
+		}
+		table.statuses[normalizeDLRStat(stat)] = DeliveryStatus(status)
+	}
+
+	for code, category := range errorCodes {
+		if !errorCategories[ErrorCategory(category)] {
+			return nil, fmt.Errorf("dlr error map of route %s maps %s onto unknown category %s", routeID, code, category)
+		}
+		table.errors[normalizeDLRErrorCode(code)] = ErrorCategory(category)
+	}
+
+	return table, nil
+}
+
+// classify returns the canonical status and error category of a dlr, stat
+// values that are not mapped are unknown and only receipts that did not
+// deliver carry an error category other than none
+func (t *dlrStatusTable) classify(stat string, errorCode string) (DeliveryStatus, ErrorCategory) {
+
+	statuses := defaultDLRStatuses
+	var errors map[string]ErrorCategory
+	if t != nil {
+		statuses = t.statuses
+		errors = t.errors
+	}
+
+	status, ok := statuses[normalizeDLRStat(stat)]
+	if !ok {
+		status = DeliveryStatusUnknown
+	}
+
+	if status == DeliveryStatusDelivered || status == DeliveryStatusEnroute {
+		return status, ErrorCategoryNone
+	}
+
+	if category, ok := errors[normalizeDLRErrorCode(errorCode)]; ok {
+		return status, category
+	}
+
+	if status == DeliveryStatusExpired {
+		return status, ErrorCategoryExpired
+	}
+	return status, ErrorCategoryUnknown
+}
+
+// normalizeDLRStat matches stat values regardless of case, the config keys
+// are lower cased when they are read anyway
+func normalizeDLRStat(stat string) string {
+	return strings.ToLower(strings.TrimSpace(stat))
+}
+
+// normalizeDLRErrorCode matches error codes regardless of zero padding so
+// 001 and 1 are the same code, an empty code is the same as 0
+func normalizeDLRErrorCode(code string) string {
+	code = strings.TrimLeft(strings.ToLower(strings.TrimSpace(code)), "0")
+	if code == "" {
+		return "0"
+	}
+	return code
+}
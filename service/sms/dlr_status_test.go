@@ -0,0 +1,59 @@
+package sms
+
+import (
+	"testing"
+
+	"github.com/fiorix/go-smpp/smpp/pdu/pdufield"
+	"github.com/fiorix/go-smpp/smpp/pdu/pdutext"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDLRStatusIsNormalized(t *testing.T) {
+
+	table, err := newDLRStatusTable("test_smsc",
+		map[string]string{"delivered": "delivered", "undeliverable": "failed"},
+		map[string]string{"001": "invalid_destination", "27": "subscriber_unavailable"})
+	assert.NoError(t, err)
+
+	for _, tc := range []struct {
+		stat     string
+		err      string
+		status   DeliveryStatus
+		category ErrorCategory
+	}{
+		{"DELIVRD", "000", DeliveryStatusDelivered, ErrorCategoryNone},
+		{"Delivered", "001", DeliveryStatusDelivered, ErrorCategoryNone},
+		{"UNDELIV", "1", DeliveryStatusFailed, ErrorCategoryInvalidDestination},
+		{"UNDELIVERABLE", "027", DeliveryStatusFailed, ErrorCategorySubscriberUnavailable},
+		{"REJECTD", "099", DeliveryStatusRejected, ErrorCategoryUnknown},
+		{"EXPIRED", "", DeliveryStatusExpired, ErrorCategoryExpired},
+		{"ACCEPTD", "", DeliveryStatusEnroute, ErrorCategoryNone},
+		{"WHATEVER", "001", DeliveryStatusUnknown, ErrorCategoryInvalidDestination},
+	} {
+		status, category := table.classify(tc.stat, tc.err)
+		assert.Equal(t, tc.status, status, tc.stat)
+		assert.Equal(t, tc.category, category, tc.stat)
+	}
+
+	_, err = newDLRStatusTable("test_smsc", map[string]string{"sent": "sent"}, nil)
+	assert.Error(t, err)
+
+	_, err = newDLRStatusTable("test_smsc", nil, map[string]string{"001": "bad_number"})
+	assert.Error(t, err)
+}
+
+func TestParsedDLRCarriesCanonicalStatus(t *testing.T) {
+
+	route := &SmppRoute{id: "test_smsc"}
+	fields := pdufield.Map{}
+	assert.NoError(t, fields.Set(pdufield.SourceAddr, "254700000001"))
+	assert.NoError(t, fields.Set(pdufield.DestinationAddr, "22333"))
+	assert.NoError(t, fields.Set(pdufield.SMDefaultMsgID, uint8(0)))
+	assert.NoError(t, fields.Set(pdufield.ShortMessage, pdutext.Raw(
+		"id:0a1b2c sub:001 dlvrd:000 submit date:2301011200 done date:2301011201 stat:UNDELIV err:001 text:hello")))
+
+	dlr := route.parseForDlr(fields, nil)
+	assert.Equal(t, "UNDELIV", dlr.SmscStatus)
+	assert.Equal(t, DeliveryStatusFailed, dlr.Status)
+	assert.Equal(t, ErrorCategoryUnknown, dlr.ErrorCategory)
+}
@@ -0,0 +1,75 @@
+package sms
+
+import (
+	"fmt"
+	"github.com/spf13/viper"
+	"regexp"
+)
+
+// inboundRule sends inbound messages matching all of its criteria to its own
+// webhook url or queue subject instead of the route's sms_receive_url
+type inboundRule struct {
+	Shortcode string   `mapstructure:"shortcode"`
+	Keywords  []string `mapstructure:"keywords"`
+	Regex     string   `mapstructure:"regex"`
+	URL       string   `mapstructure:"url"`
+	Subject   string   `mapstructure:"subject"`
+
+	pattern *regexp.Regexp
+}
+
+func loadInboundRules(routeID string) ([]*inboundRule, error) {
+
+	var rules []*inboundRule
+	err := viper.UnmarshalKey(fmt.Sprintf("%s.inbound_rules", routeID), &rules)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, rule := range rules {
+
+		if rule.URL == "" && rule.Subject == "" {
+			return nil, fmt.Errorf("inbound rule %d of route %s has neither a url nor a subject", i, routeID)
+		}
+
+		rule.Shortcode = normalizeShortcode(rule.Shortcode)
+
+		if rule.Regex != "" {
+			rule.pattern, err = regexp.Compile(rule.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("inbound rule %d of route %s has an invalid regex : %v", i, routeID, err)
+			}
+		}
+	}
+
+	return rules, nil
+}
+
+// matches checks the message against the rule returning the keyword it matched on
+func (rule *inboundRule) matches(message *SMS) (string, bool) {
+
+	if rule.Shortcode != "" && rule.Shortcode != normalizeShortcode(message.To) {
+		return "", false
+	}
+
+	keyword := firstKeyword(message.Data)
+	if len(rule.Keywords) > 0 && !matchesKeyword(keyword, rule.Keywords) {
+		return "", false
+	}
+
+	if rule.pattern != nil && !rule.pattern.MatchString(message.Data) {
+		return "", false
+	}
+
+	return keyword, true
+}
+
+// matchInboundRule returns the first rule the message matches
+func matchInboundRule(rules []*inboundRule, message *SMS) (*inboundRule, string) {
+	for _, rule := range rules {
+		if keyword, ok := rule.matches(message); ok {
+			return rule, keyword
+		}
+	}
+	return nil, ""
+}
@@ -0,0 +1,66 @@
+package sms
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func setInboundRules(t *testing.T, routeID string, rules []map[string]interface{}) {
+	viper.Set(routeID+".inbound_rules", rules)
+	t.Cleanup(func() { viper.Set(routeID+".inbound_rules", nil) })
+}
+
+func TestInboundRulesMatchInOrder(t *testing.T) {
+
+	setInboundRules(t, "rules_smsc", []map[string]interface{}{
+		{"shortcode": "+22140", "keywords": []string{"win", "play"}, "subject": "promo.entries"},
+		{"shortcode": "22140", "regex": `^\d{6}$`, "url": "https://example.com/otp"},
+		{"keywords": []string{"HELP"}, "url": "https://example.com/help"},
+		{"shortcode": "22140", "url": "https://example.com/22140"},
+	})
+
+	rules, err := loadInboundRules("rules_smsc")
+	assert.NoError(t, err)
+	assert.Len(t, rules, 4)
+
+	for _, tc := range []struct {
+		to      string
+		data    string
+		rule    int
+		keyword string
+	}{
+		{"22140", "Win a car", 0, "WIN"},
+		{"+22140", "play!", 0, "PLAY"},
+		{"22140", "123456", 1, "123456"},
+		{"22140", "help", 2, "HELP"},
+		{"22333", "help me", 2, "HELP"},
+		{"+22140", "1234567", 3, "1234567"},
+		{"22333", "win", -1, ""},
+		{"22333", "", -1, ""},
+	} {
+		rule, keyword := matchInboundRule(rules, &SMS{From: "254700000001", To: tc.to, Data: tc.data})
+		if tc.rule < 0 {
+			assert.Nil(t, rule, "%s %s", tc.to, tc.data)
+			continue
+		}
+		assert.Same(t, rules[tc.rule], rule, "%s %s", tc.to, tc.data)
+		assert.Equal(t, tc.keyword, keyword, "%s %s", tc.to, tc.data)
+	}
+}
+
+func TestInboundRulesConfigErrors(t *testing.T) {
+
+	rules, err := loadInboundRules("unconfigured_smsc")
+	assert.NoError(t, err)
+	assert.Empty(t, rules)
+
+	setInboundRules(t, "rules_smsc", []map[string]interface{}{{"shortcode": "22140"}})
+	_, err = loadInboundRules("rules_smsc")
+	assert.ErrorContains(t, err, "neither a url nor a subject")
+
+	setInboundRules(t, "rules_smsc", []map[string]interface{}{{"regex": "([0-9]", "url": "https://example.com/otp"}})
+	_, err = loadInboundRules("rules_smsc")
+	assert.ErrorContains(t, err, "invalid regex")
+}
@@ -0,0 +1,194 @@
+package sms
+
+import (
+	"antinvestor.com/service/routep/utils"
+	"context"
+	"fmt"
+	"golang.org/x/time/rate"
+	"sync"
+)
+
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityBulk   = "bulk"
+)
+
+// Priorities lists the send lanes from the most to the least urgent
+var Priorities = []string{PriorityHigh, PriorityNormal, PriorityBulk}
+
+// IsValidPriority checks that a requested priority has a lane
+func IsValidPriority(priority string) bool {
+	for _, candidate := range Priorities {
+		if candidate == priority {
+			return true
+		}
+	}
+	return false
+}
+
+// laneScheduler feeds messages from a subroute's priority lanes to the smsc.
+// High priority messages always go first, normal and bulk ones share what is
+// left by their weights and all of them draw from the one smsc rate budget.
+//
+// Messages can wait in a lane past their ack wait and be redelivered, so a
+// message is held by its id from the time it is enqueued until its
+// processing is done and redeliveries of it are dropped meanwhile.
+type laneScheduler struct {
+	lanes   map[string]chan utils.Msg
+	weights map[string]int
+	credits map[string]int
+	limiter *rate.Limiter
+	// process must hand the message off without blocking and call done once it is finished with
+	process func(m utils.Msg, done func())
+
+	mu      sync.Mutex
+	pending map[string]bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newLaneScheduler(deliveryRate int, normalWeight int, bulkWeight int, process func(m utils.Msg, done func())) *laneScheduler {
+
+	if deliveryRate < 1 {
+		deliveryRate = 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	scheduler := &laneScheduler{
+		lanes:   make(map[string]chan utils.Msg, len(Priorities)),
+		weights: map[string]int{PriorityNormal: normalWeight, PriorityBulk: bulkWeight},
+		credits: make(map[string]int),
+		limiter: rate.NewLimiter(rate.Limit(deliveryRate), deliveryRate),
+		process: process,
+		pending: make(map[string]bool),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+
+	for _, priority := range Priorities {
+		scheduler.lanes[priority] = make(chan utils.Msg, deliveryRate)
+	}
+
+	scheduler.refill()
+	return scheduler
+}
+
+// Enqueue adds a message to its lane, messages offered after the scheduler
+// stopped are left unacknowledged for redelivery. Redeliveries of a message
+// that is still waiting or being processed are dropped, the held delivery
+// acknowledges it.
+func (s *laneScheduler) Enqueue(priority string, m utils.Msg) {
+
+	if !s.hold(m.ID()) {
+		return
+	}
+
+	select {
+	case s.lanes[priority] <- m:
+	case <-s.ctx.Done():
+		s.release(m.ID())
+	}
+}
+
+// hold marks a message as pending, it is false if the message already is.
+// Messages the backend gives no id are never held.
+func (s *laneScheduler) hold(id string) bool {
+	if id == "" {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pending[id] {
+		return false
+	}
+	s.pending[id] = true
+	return true
+}
+
+func (s *laneScheduler) release(id string) {
+	if id == "" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pending, id)
+}
+
+func (s *laneScheduler) refill() {
+	for priority, weight := range s.weights {
+		if weight < 1 {
+			weight = 1
+		}
+		s.credits[priority] = weight
+	}
+}
+
+// next picks the message to send next, blocking until one is available
+func (s *laneScheduler) next() utils.Msg {
+
+	select {
+	case m := <-s.lanes[PriorityHigh]:
+		return m
+	default:
+	}
+
+	for round := 0; round < 2; round++ {
+		for _, priority := range []string{PriorityNormal, PriorityBulk} {
+			if s.credits[priority] <= 0 {
+				continue
+			}
+			select {
+			case m := <-s.lanes[priority]:
+				s.credits[priority]--
+				return m
+			default:
+			}
+		}
+		s.refill()
+	}
+
+	select {
+	case m := <-s.lanes[PriorityHigh]:
+		return m
+	case m := <-s.lanes[PriorityNormal]:
+		s.credits[PriorityNormal]--
+		return m
+	case m := <-s.lanes[PriorityBulk]:
+		s.credits[PriorityBulk]--
+		return m
+	case <-s.ctx.Done():
+		return nil
+	}
+}
+
+func (s *laneScheduler) Run() {
+	for {
+		err := s.limiter.Wait(s.ctx)
+		if err != nil {
+			return
+		}
+
+		m := s.next()
+		if m == nil {
+			return
+		}
+
+		s.process(m, func() { s.release(m.ID()) })
+	}
+}
+
+func (s *laneScheduler) Stop() {
+	s.cancel()
+}
+
+func GetSmsSendPriorityQueueName(routeID string, priority string) string {
+	if priority == "" || priority == PriorityNormal {
+		return GetSmsSendQueueName(routeID)
+	}
+	return fmt.Sprintf("%s.%s", GetSmsSendQueueName(routeID), priority)
+}
@@ -0,0 +1,66 @@
+package sms
+
+import (
+	"testing"
+
+	"antinvestor.com/service/routep/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+type laneMsg struct {
+	id   string
+	data string
+}
+
+func (m *laneMsg) Subject() string      { return "" }
+func (m *laneMsg) Data() []byte         { return []byte(m.data) }
+func (m *laneMsg) ID() string           { return m.id }
+func (m *laneMsg) Redelivered() bool    { return false }
+func (m *laneMsg) RedeliveryCount() int { return 0 }
+func (m *laneMsg) Ack() error           { return nil }
+
+func TestHighPriorityJumpsAheadOfQueuedBulk(t *testing.T) {
+
+	scheduler := newLaneScheduler(20, 2, 1, func(m utils.Msg, done func()) {})
+	defer scheduler.Stop()
+
+	for i := 0; i < 3; i++ {
+		scheduler.Enqueue(PriorityBulk, &laneMsg{data: PriorityBulk})
+	}
+	for i := 0; i < 4; i++ {
+		scheduler.Enqueue(PriorityNormal, &laneMsg{data: PriorityNormal})
+	}
+	scheduler.Enqueue(PriorityHigh, &laneMsg{data: PriorityHigh})
+
+	// Run sequentially so the order messages were picked in is observable
+	var order []string
+	for i := 0; i < 8; i++ {
+		m := scheduler.next()
+		order = append(order, string(m.Data()))
+	}
+
+	assert.Equal(t, PriorityHigh, order[0])
+	assert.Equal(t, []string{PriorityNormal, PriorityNormal, PriorityBulk, PriorityNormal, PriorityNormal, PriorityBulk, PriorityBulk}, order[1:])
+
+}
+
+func TestRedeliveriesOfPendingMessagesAreDropped(t *testing.T) {
+
+	scheduler := newLaneScheduler(20, 2, 1, func(m utils.Msg, done func()) {})
+	defer scheduler.Stop()
+
+	scheduler.Enqueue(PriorityBulk, &laneMsg{id: "1", data: "first"})
+	scheduler.Enqueue(PriorityBulk, &laneMsg{id: "1", data: "redelivered"})
+	scheduler.Enqueue(PriorityBulk, &laneMsg{id: "2", data: "second"})
+	assert.Len(t, scheduler.lanes[PriorityBulk], 2, "the redelivery of a waiting message should be dropped")
+
+	m := scheduler.next()
+	assert.Equal(t, "first", string(m.Data()))
+
+	scheduler.Enqueue(PriorityBulk, &laneMsg{id: "1", data: "redelivered"})
+	assert.Len(t, scheduler.lanes[PriorityBulk], 1, "a message is held until its processing is done")
+
+	scheduler.release(m.ID())
+	scheduler.Enqueue(PriorityBulk, &laneMsg{id: "1", data: "redelivered"})
+	assert.Len(t, scheduler.lanes[PriorityBulk], 2, "once processed a message can be delivered again")
+}
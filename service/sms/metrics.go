@@ -0,0 +1,82 @@
+package sms
+
+import (
+	"github.com/fiorix/go-smpp/smpp/pdu"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	submitsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "routep_smpp_submits_total",
+		Help: "Messages submitted to an smsc by the command status it responded with.",
+	}, []string{"route", "subroute", "status"})
+
+	submitDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "routep_smpp_submit_duration_seconds",
+		Help:    "Time taken for an smsc to respond to a submit.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "subroute"})
+
+	dlrsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "routep_dlrs_total",
+		Help: "Delivery receipts received from an smsc by their status.",
+	}, []string{"route", "status"})
+
+	dlrStatusTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "routep_dlr_status_total",
+		Help: "Delivery receipts received from an smsc by their canonical status.",
+	}, []string{"route", "status"})
+
+	inboundMessagesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "routep_inbound_messages_total",
+		Help: "Messages received from subscribers through an smsc.",
+	}, []string{"route"})
+
+	webhookAttemptsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "routep_webhook_attempts_total",
+		Help: "Webhook posts attempted by event type.",
+	}, []string{"route", "event"})
+
+	webhookFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "routep_webhook_failures_total",
+		Help: "Webhook posts that failed by event type.",
+	}, []string{"route", "event"})
+
+	webhookDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "routep_webhook_duration_seconds",
+		Help:    "Time taken by webhooks to respond by event type.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "event"})
+
+	smscBound = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "routep_smpp_bound",
+		Help: "Whether a subroute is bound to its smsc.",
+	}, []string{"route", "subroute"})
+
+	// sendBacklog is what the route's backlog tracker counts, the messages it
+	// saw published on a send lane that were not yet acked or dead lettered,
+	// rather than what the queue backend holds on the subject
+	sendBacklog = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "routep_send_backlog",
+		Help: "Messages published on a send lane that are not yet acked or dead lettered.",
+	}, []string{"route", "subject"})
+)
+
+// submitStatus names the command status an smsc answered a submit with
+func submitStatus(err error) string {
+	if err == nil {
+		return pdu.Status(0).Error()
+	}
+	if status, ok := err.(pdu.Status); ok {
+		return status.Error()
+	}
+	return "error"
+}
+
+func boolGauge(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
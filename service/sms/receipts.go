@@ -0,0 +1,184 @@
+package sms
+
+import (
+	"antinvestor.com/service/routep/utils"
+	"encoding/json"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Receipt ties the id an smsc assigned to a submitted message back to the
+// message id and metadata the client supplied when sending it.
+type Receipt struct {
+	SmscID    string            `json:"smsc_id"`
+	MessageID string            `json:"message_id"`
+	RouteID   string            `json:"route_id"`
+	From      string            `json:"from"`
+	To        string            `json:"to"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	DLRURL    string            `json:"dlr_url,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+
+	// TraceContext links delivery receipts to the trace of the submit
+	TraceContext map[string]string `json:"trace_context,omitempty"`
+}
+
+// receiptStore keeps smsc id to message id mappings for a route for as long as
+// the configured ttl. Mappings are published on the route's receipt subject so
+// that every replica can enrich delivery receipts regardless of which one
+// submitted the original message.
+type receiptStore struct {
+	routeID string
+	ttl     time.Duration
+	queue   utils.Queue
+	log     *logrus.Entry
+
+	mu       sync.RWMutex
+	receipts map[string]*Receipt
+
+	subscription utils.Subscription
+	exitSignal   chan struct{}
+}
+
+func newReceiptStore(queue utils.Queue, log *logrus.Entry, routeID string, ttl time.Duration) *receiptStore {
+	return &receiptStore{
+		routeID:    routeID,
+		ttl:        ttl,
+		queue:      queue,
+		log:        log,
+		receipts:   make(map[string]*Receipt),
+		exitSignal: make(chan struct{}),
+	}
+}
+
+func receiptKey(smscID string) string {
+	key := strings.ToLower(strings.TrimSpace(smscID))
+	trimmed := strings.TrimLeft(key, "0")
+	if trimmed == "" {
+		return key
+	}
+	return trimmed
+}
+
+// Put records the receipt locally and shares it with the other replicas
+func (s *receiptStore) Put(receipt *Receipt) error {
+
+	if receipt.SmscID == "" {
+		return nil
+	}
+
+	if receipt.CreatedAt.IsZero() {
+		receipt.CreatedAt = time.Now()
+	}
+
+	s.store(receipt)
+
+	binReceipt, err := json.Marshal(receipt)
+	if err != nil {
+		return err
+	}
+
+	return s.queue.Publish(GetSmsReceiptQueueName(s.routeID), binReceipt)
+}
+
+// Get returns the receipt recorded against the smsc id if it has not expired
+func (s *receiptStore) Get(smscID string) (*Receipt, bool) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	receipt, ok := s.receipts[receiptKey(smscID)]
+	if !ok || time.Since(receipt.CreatedAt) > s.ttl {
+		return nil, false
+	}
+	return receipt, true
+}
+
+// Enrich fills in the client's message id, metadata and callback url on a dlr
+func (s *receiptStore) Enrich(dlr *DLR) bool {
+
+	if dlr.MessageID != "" {
+		return true
+	}
+
+	receipt, ok := s.Get(dlr.SmscID)
+	if !ok {
+		return false
+	}
+
+	dlr.MessageID = receipt.MessageID
+	dlr.Metadata = receipt.Metadata
+	dlr.DLRURL = receipt.DLRURL
+	if dlr.TraceContext == nil {
+		dlr.TraceContext = receipt.TraceContext
+	}
+	return true
+}
+
+func (s *receiptStore) store(receipt *Receipt) {
+	if time.Since(receipt.CreatedAt) > s.ttl {
+		return
+	}
+
+	s.mu.Lock()
+	s.receipts[receiptKey(receipt.SmscID)] = receipt
+	s.mu.Unlock()
+}
+
+func (s *receiptStore) evictExpired() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, receipt := range s.receipts {
+		if time.Since(receipt.CreatedAt) > s.ttl {
+			delete(s.receipts, key)
+		}
+	}
+}
+
+func (s *receiptStore) start() error {
+
+	// Every replica replays the receipts still within the ttl
+	subs, err := s.queue.Subscribe(GetSmsReceiptQueueName(s.routeID), func(m utils.Msg) {
+
+		receipt := &Receipt{}
+		err := json.Unmarshal(m.Data(), receipt)
+		if err != nil {
+			s.log.WithError(err).Warnf("error decoding receipt : [ %v ] hence ignoring it", utils.RedactPayload(m.Data()))
+			return
+		}
+		s.store(receipt)
+
+	}, utils.StartAtTimeDelta(s.ttl))
+	if err != nil {
+		return err
+	}
+	s.subscription = subs
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.evictExpired()
+			case <-s.exitSignal:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (s *receiptStore) stop() {
+	close(s.exitSignal)
+	if s.subscription != nil {
+		err := s.subscription.Close()
+		if err != nil {
+			s.log.WithError(err).Warn("failed to close receipt subscription")
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package sms
+
+import (
+	"testing"
+	"time"
+
+	"antinvestor.com/service/routep/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDLRIsEnrichedWithTheClientMessageID(t *testing.T) {
+
+	queue := utils.NewMemoryQueue()
+	defer queue.Close()
+
+	log := logrus.NewEntry(logrus.New())
+	receipts := newReceiptStore(queue, log, "test_smsc", time.Hour)
+
+	assert.NoError(t, receipts.Put(&Receipt{SmscID: "000A1B2C", MessageID: "client-1", RouteID: "test_smsc",
+		Metadata: map[string]string{"team": "otp"}, DLRURL: "https://example.com/dlr",
+		TraceContext: map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}}))
+
+	dlr := &DLR{SmscID: "a1b2c", RouteID: "test_smsc", SmscStatus: "DELIVRD"}
+	assert.True(t, receipts.Enrich(dlr), "smsc ids are matched regardless of case and leading zeros")
+	assert.Equal(t, "client-1", dlr.MessageID)
+	assert.Equal(t, "otp", dlr.Metadata["team"])
+	assert.Equal(t, "https://example.com/dlr", dlr.DLRURL)
+	assert.NotEmpty(t, dlr.TraceContext)
+
+	unknown := &DLR{SmscID: "ffff", RouteID: "test_smsc", SmscStatus: "DELIVRD"}
+	assert.False(t, receipts.Enrich(unknown))
+	assert.Empty(t, unknown.MessageID)
+
+	tracked := &DLR{SmscID: "ffff", MessageID: "client-2"}
+	assert.True(t, receipts.Enrich(tracked), "dlrs that carry the message id already need no receipt")
+	assert.Equal(t, "client-2", tracked.MessageID)
+
+	// Another replica enriches dlrs for messages it did not submit
+	replica := newReceiptStore(queue, log, "test_smsc", time.Hour)
+	assert.NoError(t, replica.start())
+	defer replica.stop()
+
+	assert.Eventually(t, func() bool {
+		dlr := &DLR{SmscID: "A1B2C"}
+		return replica.Enrich(dlr) && dlr.MessageID == "client-1"
+	}, 2*time.Second, 10*time.Millisecond)
+
+	expired := newReceiptStore(queue, log, "test_smsc", time.Minute)
+	assert.NoError(t, expired.Put(&Receipt{SmscID: "0d0e0f", MessageID: "client-3", CreatedAt: time.Now().Add(-time.Hour)}))
+	assert.False(t, expired.Enrich(&DLR{SmscID: "0d0e0f"}), "receipts past their ttl are not used")
+}
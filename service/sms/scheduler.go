@@ -0,0 +1,460 @@
+package sms
+
+import (
+	"antinvestor.com/service/routep/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const messageEventSchedule = "schedule"
+
+// ErrScheduledMessageNotFound is returned when cancelling a message that is not waiting to be sent
+var ErrScheduledMessageNotFound = errors.New("scheduled message was not found")
+
+// ErrScheduleTooFarAhead is returned when a message is scheduled beyond how far ahead the route accepts
+var ErrScheduleTooFarAhead = errors.New("send_at is further ahead than the route schedules messages")
+
+// scheduleDelays are the waits of the delay subjects a scheduled message
+// moves through until it is due, from the shortest to the longest
+var scheduleDelays = []time.Duration{time.Minute, 10 * time.Minute, time.Hour, 6 * time.Hour, 24 * time.Hour, 72 * time.Hour}
+
+// ScheduleCancellation asks the replicas to drop a scheduled message
+type ScheduleCancellation struct {
+	MessageID string    `json:"message_id"`
+	RouteID   string    `json:"route_id"`
+	SendAt    time.Time `json:"send_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// scheduleEntry records that a message is waiting to be sent so any replica
+// can tell whether a cancellation is for a message it knows of
+type scheduleEntry struct {
+	MessageID string    `json:"message_id"`
+	SendAt    time.Time `json:"send_at"`
+}
+
+// delayedMessage is a scheduled message waiting on a delay subject
+type delayedMessage struct {
+	ReadyAt time.Time `json:"ready_at"`
+	Message *SMS      `json:"message"`
+}
+
+// messageScheduler holds messages with a send_at time until they are due.
+// Messages due within the shortest delay wait on the route's schedule subject,
+// the rest are moved to the longest delay subject that does not overshoot
+// their send_at and come back to the schedule subject once its delay is over.
+// Every delay subject holds messages in the order they become ready so the
+// messages held at its head are always the next ones due, and all subjects are
+// consumed by durable queue groups and only acknowledged once a message moves
+// on so messages survive restarts.
+//
+// Each replica keeps an index of the scheduled message ids and the
+// cancellations, both only go back as far ahead as messages can be scheduled.
+type messageScheduler struct {
+	routeID       string
+	queue         utils.Queue
+	log           *logrus.Entry
+	deadLetters   *deadLetterBox
+	checkInterval time.Duration
+	maxPending    int
+	maxAhead      time.Duration
+	delays        []time.Duration
+	release       func(message *SMS) error
+
+	mu        sync.Mutex
+	scheduled map[string]time.Time
+	cancelled map[string]time.Time
+	timers    map[string]*time.Timer
+
+	subscriptions []utils.Subscription
+	exitSignal    chan struct{}
+}
+
+func newMessageScheduler(queue utils.Queue, log *logrus.Entry, routeID string, deadLetters *deadLetterBox,
+	checkInterval time.Duration, maxPending int, maxAhead time.Duration, release func(message *SMS) error) *messageScheduler {
+	return &messageScheduler{
+		routeID:       routeID,
+		queue:         queue,
+		log:           log,
+		deadLetters:   deadLetters,
+		checkInterval: checkInterval,
+		maxPending:    maxPending,
+		maxAhead:      maxAhead,
+		delays:        scheduleDelays,
+		release:       release,
+		scheduled:     make(map[string]time.Time),
+		cancelled:     make(map[string]time.Time),
+		timers:        make(map[string]*time.Timer),
+		exitSignal:    make(chan struct{}),
+	}
+}
+
+// Schedule persists a message until its send_at time
+func (s *messageScheduler) Schedule(message *SMS) error {
+
+	if message.SendAt != nil && time.Until(*message.SendAt) > s.maxAhead {
+		return ErrScheduleTooFarAhead
+	}
+
+	if message.MessageID != "" && message.SendAt != nil {
+
+		entry := &scheduleEntry{MessageID: message.MessageID, SendAt: *message.SendAt}
+		s.index(entry)
+
+		binEntry, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+
+		err = s.queue.Publish(GetScheduleIndexQueueName(s.routeID), binEntry)
+		if err != nil {
+			return err
+		}
+	}
+
+	binMessage, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	return s.queue.Publish(GetSmsScheduleQueueName(s.routeID), binMessage)
+}
+
+// Cancel stops a scheduled message from being released, messages that are
+// not known or already due can't be cancelled
+func (s *messageScheduler) Cancel(messageID string) error {
+
+	s.mu.Lock()
+	sendAt, ok := s.scheduled[messageID]
+	s.mu.Unlock()
+
+	if !ok || !time.Now().Before(sendAt) {
+		return ErrScheduledMessageNotFound
+	}
+
+	cancellation := &ScheduleCancellation{
+		MessageID: messageID,
+		RouteID:   s.routeID,
+		SendAt:    sendAt,
+		CreatedAt: time.Now(),
+	}
+
+	binCancellation, err := json.Marshal(cancellation)
+	if err != nil {
+		return err
+	}
+
+	s.cancel(cancellation)
+	return s.queue.Publish(GetScheduleCancelQueueName(s.routeID), binCancellation)
+}
+
+func (s *messageScheduler) index(entry *scheduleEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry.SendAt.After(time.Now()) {
+		s.scheduled[entry.MessageID] = entry.SendAt
+	}
+}
+
+func (s *messageScheduler) cancel(cancellation *ScheduleCancellation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Cancellations from before they carried the send_at are kept as long as any message could still be waiting
+	expiresAt := cancellation.SendAt
+	if expiresAt.IsZero() {
+		expiresAt = cancellation.CreatedAt.Add(s.maxAhead)
+	}
+
+	s.cancelled[cancellation.MessageID] = expiresAt
+	if timer, ok := s.timers[cancellation.MessageID]; ok {
+		timer.Stop()
+		delete(s.timers, cancellation.MessageID)
+	}
+}
+
+func (s *messageScheduler) isCancelled(messageID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.cancelled[messageID]
+	return ok
+}
+
+// evictExpired forgets the messages and cancellations that are past due, a
+// check interval of grace lets cancellations reach messages being released
+func (s *messageScheduler) evictExpired() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := time.Now().Add(-s.checkInterval)
+	for messageID, sendAt := range s.scheduled {
+		if sendAt.Before(cutoff) {
+			delete(s.scheduled, messageID)
+		}
+	}
+	for messageID, expiresAt := range s.cancelled {
+		if expiresAt.Before(cutoff) {
+			delete(s.cancelled, messageID)
+		}
+	}
+}
+
+// hold runs fire once the wait is over, the message is left unacknowledged
+// meanwhile so another replica picks it up should this one go away
+func (s *messageScheduler) hold(messageID string, wait time.Duration, fire func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.timers[messageID] = time.AfterFunc(wait, func() {
+		s.mu.Lock()
+		delete(s.timers, messageID)
+		s.mu.Unlock()
+
+		fire()
+	})
+}
+
+// delayFor picks the delay subject for a message due after the wait, it is
+// false when the message is due within the shortest delay
+func (s *messageScheduler) delayFor(wait time.Duration) (int, bool) {
+	stage := -1
+	for i, delay := range s.delays {
+		if delay <= wait {
+			stage = i
+		}
+	}
+	return stage, stage >= 0
+}
+
+func (s *messageScheduler) handle(m utils.Msg) {
+
+	message := &SMS{}
+	err := json.Unmarshal(m.Data(), message)
+	if err != nil {
+		s.log.WithError(err).Errorf("error decoding scheduled message : [ %v  ] hence dead lettering it", utils.RedactPayload(m.Data()))
+		s.deadLetter(m, err)
+		return
+	}
+
+	if s.isCancelled(message.MessageID) {
+		s.log.WithFields(message.logFields()).Infof("dropping scheduled message with id : %s as it was cancelled", message.MessageID)
+		s.ack(m)
+		return
+	}
+
+	wait := time.Duration(0)
+	if message.SendAt != nil {
+		wait = time.Until(*message.SendAt)
+	}
+
+	if wait <= 0 {
+		s.releaseMessage(message, m)
+		return
+	}
+
+	stage, ok := s.delayFor(wait)
+	if !ok {
+		s.hold(message.MessageID, wait, func() {
+			s.releaseMessage(message, m)
+		})
+		return
+	}
+
+	err = s.delay(message, stage)
+	if err != nil {
+		// Left unacknowledged so it is handled again once the ack wait is over
+		s.log.WithError(err).WithFields(message.logFields()).Warnf("could not delay scheduled message with id : %s", message.MessageID)
+		return
+	}
+	s.ack(m)
+}
+
+func (s *messageScheduler) delay(message *SMS, stage int) error {
+
+	binMessage, err := json.Marshal(&delayedMessage{ReadyAt: time.Now().Add(s.delays[stage]), Message: message})
+	if err != nil {
+		return err
+	}
+
+	return s.queue.Publish(GetScheduleDelayQueueName(s.routeID, stage), binMessage)
+}
+
+// handleDelayed hands a message back to the schedule subject once its delay is over
+func (s *messageScheduler) handleDelayed(m utils.Msg) {
+
+	delayed := &delayedMessage{}
+	err := json.Unmarshal(m.Data(), delayed)
+	if err != nil || delayed.Message == nil {
+		if err == nil {
+			err = errors.New("delayed message is empty")
+		}
+		s.log.WithError(err).Errorf("error decoding delayed message : [ %v  ] hence dead lettering it", utils.RedactPayload(m.Data()))
+		s.deadLetter(m, err)
+		return
+	}
+
+	message := delayed.Message
+	if s.isCancelled(message.MessageID) {
+		s.log.WithFields(message.logFields()).Infof("dropping scheduled message with id : %s as it was cancelled", message.MessageID)
+		s.ack(m)
+		return
+	}
+
+	s.hold(message.MessageID, time.Until(delayed.ReadyAt), func() {
+
+		binMessage, err := json.Marshal(message)
+		if err == nil {
+			err = s.queue.Publish(GetSmsScheduleQueueName(s.routeID), binMessage)
+		}
+		if err != nil {
+			s.log.WithError(err).WithFields(message.logFields()).Warnf("could not requeue scheduled message with id : %s", message.MessageID)
+			return
+		}
+		s.ack(m)
+	})
+}
+
+func (s *messageScheduler) releaseMessage(message *SMS, m utils.Msg) {
+
+	if s.isCancelled(message.MessageID) {
+		s.log.WithFields(message.logFields()).Infof("dropping scheduled message with id : %s as it was cancelled", message.MessageID)
+		s.ack(m)
+		return
+	}
+
+	message.SendAt = nil
+	err := s.release(message)
+	if err == ErrRecipientSuppressed {
+		s.log.WithFields(message.logFields()).Infof("dropping scheduled message with id : %s as the recipient opted out", message.MessageID)
+		s.ack(m)
+		return
+	}
+	if err != nil {
+		// Left unacknowledged so it is released again once the ack wait is over
+		s.log.WithError(err).WithFields(message.logFields()).Warnf("could not release scheduled message with id : %s", message.MessageID)
+		return
+	}
+
+	s.log.WithFields(message.logFields()).Infof("released scheduled message with id : %s", message.MessageID)
+	s.ack(m)
+}
+
+func (s *messageScheduler) ack(m utils.Msg) {
+	err := m.Ack()
+	if err != nil {
+		s.log.WithError(err).Warn("error occurred on attempting acknowledge scheduled message")
+	}
+}
+
+func (s *messageScheduler) deadLetter(m utils.Msg, cause error) {
+
+	err := s.deadLetters.Add(&DeadLetter{
+		RouteID:  s.routeID,
+		Event:    messageEventSchedule,
+		Subject:  m.Subject(),
+		Payload:  m.Data(),
+		Error:    cause.Error(),
+		Attempts: m.RedeliveryCount() + 1,
+	})
+	if err != nil {
+		s.log.WithError(err).Errorf("unable to dead letter message from : %s", m.Subject())
+		return
+	}
+
+	s.ack(m)
+}
+
+func (s *messageScheduler) start() error {
+
+	// Every replica replays the index and the cancellations so whichever one holds a message knows to drop it
+	indexSubs, err := s.queue.Subscribe(GetScheduleIndexQueueName(s.routeID), func(m utils.Msg) {
+
+		entry := &scheduleEntry{}
+		err := json.Unmarshal(m.Data(), entry)
+		if err != nil {
+			s.log.WithError(err).Warnf("error decoding schedule entry : [ %v ] hence ignoring it", utils.RedactPayload(m.Data()))
+			return
+		}
+		s.index(entry)
+
+	}, utils.StartAtTimeDelta(s.maxAhead))
+	if err != nil {
+		return err
+	}
+	s.subscriptions = append(s.subscriptions, indexSubs)
+
+	cancelSubs, err := s.queue.Subscribe(GetScheduleCancelQueueName(s.routeID), func(m utils.Msg) {
+
+		cancellation := &ScheduleCancellation{}
+		err := json.Unmarshal(m.Data(), cancellation)
+		if err != nil {
+			s.log.WithError(err).Warnf("error decoding schedule cancellation : [ %v ] hence ignoring it", utils.RedactPayload(m.Data()))
+			return
+		}
+		s.cancel(cancellation)
+
+	}, utils.StartAtTimeDelta(s.maxAhead))
+	if err != nil {
+		return err
+	}
+	s.subscriptions = append(s.subscriptions, cancelSubs)
+
+	subs, err := s.queue.QueueSubscribe(GetSmsScheduleQueueName(s.routeID), GetQueueGroup(s.routeID), s.handle,
+		utils.DeliverAllAvailable(), utils.DurableName(s.routeID+"_schedule_sub"), utils.SetManualAckMode(),
+		utils.AckWait(s.delays[0]+s.checkInterval), utils.MaxInflight(s.maxPending))
+	if err != nil {
+		return err
+	}
+	s.subscriptions = append(s.subscriptions, subs)
+
+	for stage, delay := range s.delays {
+		subs, err = s.queue.QueueSubscribe(GetScheduleDelayQueueName(s.routeID, stage), GetQueueGroup(s.routeID), s.handleDelayed,
+			utils.DeliverAllAvailable(), utils.DurableName(fmt.Sprintf("%s_schedule_delay_%d_sub", s.routeID, stage)),
+			utils.SetManualAckMode(), utils.AckWait(delay+s.checkInterval), utils.MaxInflight(s.maxPending))
+		if err != nil {
+			return err
+		}
+		s.subscriptions = append(s.subscriptions, subs)
+	}
+
+	go func() {
+		ticker := time.NewTicker(s.checkInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.evictExpired()
+			case <-s.exitSignal:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (s *messageScheduler) stop() {
+
+	close(s.exitSignal)
+
+	// Messages waiting on a timer are unacknowledged so another replica picks them up
+	s.mu.Lock()
+	for messageID, timer := range s.timers {
+		timer.Stop()
+		delete(s.timers, messageID)
+	}
+	s.mu.Unlock()
+
+	for _, subscription := range s.subscriptions {
+		err := subscription.Close()
+		if err != nil {
+			s.log.WithError(err).Warn("failed to close schedule subscription")
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package sms
+
+import (
+	"testing"
+	"time"
+
+	"antinvestor.com/service/routep/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduledMessagesAreReleasedWhenDueUnlessCancelled(t *testing.T) {
+
+	queue := utils.NewMemoryQueue()
+	defer queue.Close()
+
+	log := logrus.NewEntry(logrus.New())
+	released := make(chan *SMS, 2)
+	scheduler := newMessageScheduler(queue, log, "test_smsc",
+		newDeadLetterBox(queue, log, GetSmsDeadLetterQueueName("test_smsc"), time.Hour), time.Second, 100, time.Hour,
+		func(message *SMS) error {
+			released <- message
+			return nil
+		})
+	assert.NoError(t, scheduler.start())
+	defer scheduler.stop()
+
+	sendAt := time.Now().Add(200 * time.Millisecond)
+	assert.NoError(t, scheduler.Schedule(&SMS{MessageID: "kept", SendAt: &sendAt}))
+	assert.NoError(t, scheduler.Schedule(&SMS{MessageID: "cancelled", SendAt: &sendAt}))
+	assert.NoError(t, scheduler.Cancel("cancelled"))
+
+	select {
+	case message := <-released:
+		assert.Equal(t, "kept", message.MessageID)
+		assert.False(t, time.Now().Before(sendAt), "message was released early")
+		assert.Nil(t, message.SendAt)
+	case <-time.After(2 * time.Second):
+		t.Fatal("scheduled message was not released")
+	}
+
+	select {
+	case message := <-released:
+		t.Fatalf("cancelled message %s was released", message.MessageID)
+	case <-time.After(1500 * time.Millisecond):
+	}
+}
+
+func TestFarOffMessagesDoNotHoldUpDueOnes(t *testing.T) {
+
+	queue := utils.NewMemoryQueue()
+	defer queue.Close()
+
+	log := logrus.NewEntry(logrus.New())
+	released := make(chan *SMS, 2)
+	// A single pending slot would be taken by the far off message if it was held until due
+	scheduler := newMessageScheduler(queue, log, "test_smsc",
+		newDeadLetterBox(queue, log, GetSmsDeadLetterQueueName("test_smsc"), time.Hour), time.Second, 1, time.Hour,
+		func(message *SMS) error {
+			released <- message
+			return nil
+		})
+	scheduler.delays = []time.Duration{100 * time.Millisecond, 400 * time.Millisecond}
+	assert.NoError(t, scheduler.start())
+	defer scheduler.stop()
+
+	farAt := time.Now().Add(1500 * time.Millisecond)
+	assert.NoError(t, scheduler.Schedule(&SMS{MessageID: "far", SendAt: &farAt}))
+	soonAt := time.Now().Add(150 * time.Millisecond)
+	assert.NoError(t, scheduler.Schedule(&SMS{MessageID: "soon", SendAt: &soonAt}))
+
+	for _, expected := range []struct {
+		id     string
+		sendAt time.Time
+	}{{"soon", soonAt}, {"far", farAt}} {
+		select {
+		case message := <-released:
+			assert.Equal(t, expected.id, message.MessageID)
+			assert.False(t, time.Now().Before(expected.sendAt), "message was released early")
+			assert.WithinDuration(t, expected.sendAt, time.Now(), 300*time.Millisecond, "message was released late")
+		case <-time.After(3 * time.Second):
+			t.Fatalf("scheduled message %s was not released", expected.id)
+		}
+	}
+}
+
+func TestCancellingUnknownScheduledMessages(t *testing.T) {
+
+	queue := utils.NewMemoryQueue()
+	defer queue.Close()
+
+	log := logrus.NewEntry(logrus.New())
+	scheduler := newMessageScheduler(queue, log, "test_smsc",
+		newDeadLetterBox(queue, log, GetSmsDeadLetterQueueName("test_smsc"), time.Hour), time.Second, 100, time.Hour,
+		func(message *SMS) error { return nil })
+
+	assert.Equal(t, ErrScheduledMessageNotFound, scheduler.Cancel("unknown"))
+
+	tooFar := time.Now().Add(2 * time.Hour)
+	assert.Equal(t, ErrScheduleTooFarAhead, scheduler.Schedule(&SMS{MessageID: "far", SendAt: &tooFar}))
+
+	sendAt := time.Now().Add(-2 * time.Second)
+	scheduler.index(&scheduleEntry{MessageID: "due", SendAt: time.Now().Add(time.Minute)})
+	scheduler.cancel(&ScheduleCancellation{MessageID: "gone", SendAt: sendAt})
+	scheduler.scheduled["released"] = sendAt
+	scheduler.evictExpired()
+
+	assert.Contains(t, scheduler.scheduled, "due")
+	assert.NotContains(t, scheduler.scheduled, "released", "messages past due are forgotten")
+	assert.NotContains(t, scheduler.cancelled, "gone", "cancellations expire with the message they cancel")
+}
@@ -1,13 +1,17 @@
 package sms
 
 import (
+	"antinvestor.com/service/routep/utils"
+	"context"
 	"fmt"
 	"github.com/fiorix/go-smpp/smpp"
 	"github.com/fiorix/go-smpp/smpp/pdu"
 	"github.com/fiorix/go-smpp/smpp/pdu/pdufield"
-	"github.com/nats-io/stan.go"
+	"antinvestor.com/service/routep/pdujournal"
 	"github.com/sirupsen/logrus"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,17 +19,39 @@ type SmppRoute struct {
 	id         string
 	active     bool
 	log        *logrus.Entry
-	queue      stan.Conn
+	queue      utils.Queue
+	receipts   *receiptStore
+	webhook    *webhookDispatcher
 	exitSignal chan int
 	txConn     <-chan smpp.ConnStatus
 
+	// stopping is closed once the route stops taking on new work
+	stopping     chan struct{}
+	stoppingOnce sync.Once
+	inflight     int64
+
+	// workCtx is cancelled once draining runs out of time so webhook retries give up
+	workCtx    context.Context
+	cancelWork context.CancelFunc
+
 	trx *smpp.Transceiver
 	tr  *smpp.Transmitter
 
-	sendSubscription           stan.Subscription
-	sendAckSubscription        stan.Subscription
-	receiveMessageSubscription stan.Subscription
-	receiveDLRSubscription     stan.Subscription
+	sendSubscriptions          []utils.Subscription
+	sendScheduler              *laneScheduler
+	sendAckSubscription        utils.Subscription
+	receiveMessageSubscription utils.Subscription
+	receiveDLRSubscription     utils.Subscription
+
+	suppressions       *suppressionList
+	inboundRules       []*inboundRule
+	dlrStatuses        *dlrStatusTable
+	webhookClient      *webhookClient
+	webhookDeadLetters *deadLetterBox
+	messageDeadLetters *deadLetterBox
+	journal            *pdujournal.Journal
+	journalTap         *pdujournal.Tap
+	stats              *routeStats
 
 	settingAddress        string
 	settingUser           string
@@ -37,19 +63,125 @@ type SmppRoute struct {
 	settingDestinationTon uint8
 	settingDestinationNpi uint8
 	settingDLRLevel       uint8
+	settingDLRTimezone    *time.Location
 
 	settingSmsSendAckUrl string
 	settingSmsSendDLRUrl string
 	settingSmsReceiveUrl string
 
+	settingWebhookRetrySchedule []time.Duration
+	settingWebhookMaxAttempts   int
+	settingWebhookSecret        string
+	settingWebhookFormat        string
+	settingWebhookBodyTemplate  string
+
 	settingDisableTLVTrackingID bool
 	settingSmsCDeliveryRate     uint64
+	settingNormalPriorityWeight int
+	settingBulkPriorityWeight   int
 
 	settingOperatesSynchronously bool
+	settingMaxRedeliveries       int
+}
+
+// StopConsuming closes the route's queue subscriptions, durable ones resume
+// from where they left off once the route starts again
+func (r *SmppRoute) StopConsuming() {
+	r.stoppingOnce.Do(func() {
+		close(r.stopping)
+
+		if r.sendScheduler != nil {
+			r.sendScheduler.Stop()
+		}
+
+		subscriptions := append([]utils.Subscription{r.sendAckSubscription, r.receiveMessageSubscription,
+			r.receiveDLRSubscription}, r.sendSubscriptions...)
+		for _, subscription := range subscriptions {
+			if subscription == nil {
+				continue
+			}
+			err := subscription.Close()
+			if err != nil {
+				r.log.WithError(err).Warn("failed to close subscription on stopping")
+			}
+		}
+	})
+}
+
+func (r *SmppRoute) isStopping() bool {
+	select {
+	case <-r.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// inFlight runs work in its own goroutine and counts it until it is done
+// so that stopping the route can wait on it
+func (r *SmppRoute) inFlight(work func()) {
+	atomic.AddInt64(&r.inflight, 1)
+	go func() {
+		defer atomic.AddInt64(&r.inflight, -1)
+		work()
+	}()
+}
+
+// workContext is the context in flight work runs under
+func (r *SmppRoute) workContext() context.Context {
+	if r.workCtx == nil {
+		return context.Background()
+	}
+	return r.workCtx
 }
 
+// Drain waits for in flight submits and webhook posts to finish or the context
+// to expire, on expiring in flight webhook retries are cut short and their
+// events are left on the queue for redelivery
+func (r *SmppRoute) Drain(ctx context.Context) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for atomic.LoadInt64(&r.inflight) > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if r.cancelWork != nil {
+				r.cancelWork()
+			}
+			return fmt.Errorf("%d tasks still in flight : %w", atomic.LoadInt64(&r.inflight), ctx.Err())
+		}
+	}
+	return nil
+}
+
+// Stop unbinds from the smsc and ends the route's run loop
 func (r *SmppRoute) Stop() {
-	r.exitSignal <- 1
+	r.StopConsuming()
+
+	// Signalled before closing as closing the client closes its status channel
+	select {
+	case r.exitSignal <- 1:
+	default:
+	}
+
+	if r.trx != nil {
+		err := r.trx.Close()
+		if err != nil {
+			r.log.WithError(err).Warn("failed to unbind transceiver")
+		}
+	}
+	if r.tr != nil {
+		err := r.tr.Close()
+		if err != nil {
+			r.log.WithError(err).Warn("failed to unbind transmitter")
+		}
+	}
+
+	r.closeJournalTap()
+
+	smscBound.WithLabelValues(r.ID(), r.settingAddress).Set(0)
+	r.stats.recordBind(time.Now(), smpp.Disconnected)
 }
 
 func (r *SmppRoute) ID() string {
@@ -64,6 +196,11 @@ func (r *SmppRoute) CanQueue() bool {
 	return !r.settingOperatesSynchronously
 }
 
+// Status reports the bind and recent traffic of the subroute
+func (r *SmppRoute) Status() SubRouteStatus {
+	return r.stats.status(time.Now(), r.settingAddress)
+}
+
 // Handler handles DeliverSM coming from a Transceiver SMPP connection.
 // It broadcasts received delivery receipt to all registered peers.
 func (r *SmppRoute) SmscHandler(p pdu.Body) {
@@ -72,12 +209,17 @@ func (r *SmppRoute) SmscHandler(p pdu.Body) {
 
 	switch p.Header().ID {
 	case pdu.DeliverSMID:
-		dlr := r.parseForDlr(p.Fields())
+		dlr := r.parseForDlr(p.Fields(), p.TLVFields())
 		dlr.RouteID = r.ID()
-		err := r.processDLRMessage(dlr, r.CanQueue())
-		if err != nil {
-			r.log.WithError(err).Errorf("error occurred post processing dlr")
-		}
+		dlrsTotal.WithLabelValues(r.ID(), dlr.SmscStatus).Inc()
+		dlrStatusTotal.WithLabelValues(r.ID(), string(dlr.Status)).Inc()
+		r.stats.recordDLR(time.Now(), dlr.Status, r.submittedAt(dlr.SmscID))
+		r.inFlight(func() {
+			err := r.processDLRMessage(dlr, r.CanQueue())
+			if err != nil {
+				r.log.WithError(err).Errorf("error occurred post processing dlr")
+			}
+		})
 		break
 	case pdu.DataSMID:
 		f := p.Fields()
@@ -89,10 +231,24 @@ func (r *SmppRoute) SmscHandler(p pdu.Body) {
 			SmscID:  f[pdufield.MessageID].String(),
 			RouteID: r.ID(),
 		}
-		err := r.processMTMessage(message, r.CanQueue())
-		if err != nil {
-			r.log.WithError(err).Errorf("error occurred post processing inbound message")
-		}
+		inboundMessagesTotal.WithLabelValues(r.ID()).Inc()
+		r.inFlight(func() {
+			reply, err := r.suppressions.HandleKeyword(message)
+			if err != nil {
+				r.log.WithError(err).Errorf("error occurred updating suppression list")
+			}
+			if reply != nil {
+				_, err = r.SendMOMessage(reply)
+				if err != nil {
+					r.log.WithError(err).Warnf("could not send opt out auto reply to %s", utils.RedactMSISDN(reply.To))
+				}
+			}
+
+			err = r.processMTMessage(message, r.CanQueue())
+			if err != nil {
+				r.log.WithError(err).Errorf("error occurred post processing inbound message")
+			}
+		})
 	}
 }
 
@@ -105,19 +261,28 @@ func (r *SmppRoute) Init() {
 		err := r.Run()
 		if err != nil {
 			r.log.WithError(err).Warnf("SubRoute stopping error occurred, app will reattempt connection in 2 minutes")
-			<-time.After(5 * time.Minute)
+			select {
+			case <-time.After(5 * time.Minute):
+			case <-r.stopping:
+				return
+			}
 		}else{
 			r.log.Info("Exiting route gracefully")
 		}
 
-
-
+		if r.isStopping() {
+			return
+		}
 	}
 
 }
 
 func (r *SmppRoute) Run() error {
 
+	if r.isStopping() {
+		return nil
+	}
+
 	err := subscribeForAckEvents(r)
 	if err != nil {
 		return err
@@ -141,7 +306,7 @@ func (r *SmppRoute) getSettings() {
 	// These should be prefixed with route name from configs
 
 	r.settingUser = GetSetting(fmt.Sprintf("%s.user", r.ID()), "")
-	r.log.Infof("Route [%v] setting :  settingUser = %s", r.ID(), r.settingUser)
+	r.log.Infof("Route [%v] setting :  settingUser = %s", r.ID(), utils.RedactSecret(r.settingUser))
 
 	r.settingPassword = GetSetting(fmt.Sprintf("%s.password", r.ID()), "")
 
@@ -196,6 +361,14 @@ func (r *SmppRoute) getSettings() {
 	r.settingDLRLevel = uint8(sett)
 	r.log.Infof("Route [%v] setting :  settingDLRLevel = %d", r.ID(), r.settingDLRLevel)
 
+	dlrTimezone := GetSetting(fmt.Sprintf("%s.dlr_timezone", r.ID()), "UTC")
+	r.settingDLRTimezone, err = time.LoadLocation(dlrTimezone)
+	if err != nil {
+		r.log.WithError(err).Warnf("Route [%v] dlr timezone is invalid, falling back to UTC", r.ID())
+		r.settingDLRTimezone = time.UTC
+	}
+	r.log.Infof("Route [%v] setting :  settingDLRTimezone = %v", r.ID(), r.settingDLRTimezone)
+
 	r.settingSmsReceiveUrl = GetSetting(fmt.Sprintf("%s.sms_receive_url", r.ID()), "")
 	r.log.Infof("Route [%v] setting :  settingSmsReceiveUrl = %s", r.ID(), r.settingSmsReceiveUrl)
 
@@ -205,6 +378,39 @@ func (r *SmppRoute) getSettings() {
 	r.settingSmsSendAckUrl = GetSetting(fmt.Sprintf("%s.sms_send_ack_url", r.ID()), "")
 	r.log.Infof("Route [%v] setting :  settingSmsSendAckUrl = %v", r.ID(), r.settingSmsSendAckUrl)
 
+	retrySchedule := GetSetting(fmt.Sprintf("%s.webhook_retry_schedule", r.ID()), "10s,1m,5m,15m")
+	r.settingWebhookRetrySchedule, err = parseRetrySchedule(retrySchedule)
+	if err != nil {
+		r.settingWebhookRetrySchedule = []time.Duration{10 * time.Second, time.Minute, 5 * time.Minute, 15 * time.Minute}
+	}
+	r.log.Infof("Route [%v] setting :  settingWebhookRetrySchedule = %v", r.ID(), r.settingWebhookRetrySchedule)
+
+	webhookMaxAttempts := GetSetting(fmt.Sprintf("%s.webhook_max_attempts", r.ID()), "5")
+	sett, err = strconv.ParseUint(webhookMaxAttempts, 10, 8)
+	if err != nil {
+		sett = 5
+	}
+	r.settingWebhookMaxAttempts = int(sett)
+	r.log.Infof("Route [%v] setting :  settingWebhookMaxAttempts = %d", r.ID(), r.settingWebhookMaxAttempts)
+
+	r.settingWebhookSecret = GetSetting(fmt.Sprintf("%s.webhook_secret", r.ID()), "")
+	r.log.Infof("Route [%v] setting :  settingWebhookSecret set = %v", r.ID(), r.settingWebhookSecret != "")
+
+	r.settingWebhookFormat = GetSetting(fmt.Sprintf("%s.webhook_format", r.ID()), webhookFormatJSON)
+	r.log.Infof("Route [%v] setting :  settingWebhookFormat = %s", r.ID(), r.settingWebhookFormat)
+
+	r.settingWebhookBodyTemplate = GetSetting(fmt.Sprintf("%s.webhook_body_template", r.ID()), "")
+	r.log.Infof("Route [%v] setting :  settingWebhookBodyTemplate = %s", r.ID(), r.settingWebhookBodyTemplate)
+
+	formatter, err := newWebhookFormatter(r.ID(), r.settingWebhookFormat, r.settingWebhookBodyTemplate)
+	if err != nil {
+		r.log.WithError(err).Warnf("Route [%v] webhook format is invalid, falling back to json", r.ID())
+		formatter, _ = newWebhookFormatter(r.ID(), webhookFormatJSON, "")
+	}
+
+	r.webhook = newWebhookDispatcher(r.log, r.ID(), r.webhookClient, formatter, r.settingWebhookRetrySchedule,
+		r.settingWebhookMaxAttempts, r.settingWebhookSecret, r.webhookDeadLetters)
+
 	disableTlv := GetSetting(fmt.Sprintf("%s.disable_tlv_options", r.ID()), "False")
 	settTlv, err := strconv.ParseBool(disableTlv)
 	if err != nil {
@@ -220,6 +426,20 @@ func (r *SmppRoute) getSettings() {
 	}
 	r.log.Infof("Route [%v] setting :  settingSmsCDeliveryRate = %d", r.ID(), r.settingSmsCDeliveryRate)
 
+	normalPriorityWeight := GetSetting(fmt.Sprintf("%s.normal_priority_weight", r.ID()), "4")
+	r.settingNormalPriorityWeight, err = strconv.Atoi(normalPriorityWeight)
+	if err != nil {
+		r.settingNormalPriorityWeight = 4
+	}
+	r.log.Infof("Route [%v] setting :  settingNormalPriorityWeight = %d", r.ID(), r.settingNormalPriorityWeight)
+
+	bulkPriorityWeight := GetSetting(fmt.Sprintf("%s.bulk_priority_weight", r.ID()), "1")
+	r.settingBulkPriorityWeight, err = strconv.Atoi(bulkPriorityWeight)
+	if err != nil {
+		r.settingBulkPriorityWeight = 1
+	}
+	r.log.Infof("Route [%v] setting :  settingBulkPriorityWeight = %d", r.ID(), r.settingBulkPriorityWeight)
+
 	operatesSynchronously := GetSetting(fmt.Sprintf("%s.operates_synchronously", r.ID()), "True")
 	settOperatesSynchronously, err := strconv.ParseBool(operatesSynchronously)
 	if err != nil {
@@ -228,18 +448,97 @@ func (r *SmppRoute) getSettings() {
 	r.settingOperatesSynchronously = settOperatesSynchronously
 	r.log.Infof("Route [%v] setting :  settingOperatesSynchronously = %v", r.ID(), r.settingOperatesSynchronously)
 
+	maxRedeliveries := GetSetting(fmt.Sprintf("%s.max_redeliveries", r.ID()), "10")
+	r.settingMaxRedeliveries, err = strconv.Atoi(maxRedeliveries)
+	if err != nil {
+		r.settingMaxRedeliveries = 10
+	}
+	r.log.Infof("Route [%v] setting :  settingMaxRedeliveries = %d", r.ID(), r.settingMaxRedeliveries)
+
+}
+
+// isPoison is true once a queued message has been redelivered as many times as the route allows
+func (r *SmppRoute) isPoison(m utils.Msg) bool {
+	return r.settingMaxRedeliveries > 0 && m.RedeliveryCount() >= r.settingMaxRedeliveries
+}
+
+// deadLetterMessage moves a queued message the route can't process to the
+// route's dead letter subject and acknowledges it. If dead lettering fails the
+// message is left for redelivery.
+func (r *SmppRoute) deadLetterMessage(event string, m utils.Msg, cause error) {
+
+	err := r.messageDeadLetters.Add(&DeadLetter{
+		RouteID:  r.ID(),
+		Event:    event,
+		Subject:  m.Subject(),
+		Payload:  m.Data(),
+		Error:    cause.Error(),
+		Attempts: m.RedeliveryCount() + 1,
+	})
+	if err != nil {
+		r.log.WithError(err).Errorf("unable to dead letter message from : %s", m.Subject())
+		return
+	}
+
+	err = m.Ack()
+	if err != nil {
+		r.log.WithError(err).Error("error acknowledging dead lettered message")
+	}
+}
+
+// submittedAt is when the message a dlr is for was submitted if the route still has its receipt
+func (r *SmppRoute) submittedAt(smscID string) time.Time {
+	if r.receipts == nil {
+		return time.Time{}
+	}
+	receipt, ok := r.receipts.Get(smscID)
+	if !ok {
+		return time.Time{}
+	}
+	return receipt.CreatedAt
+}
+
+// journalAddr is the address the smpp client dials, with journaling on it
+// is a tap that records the PDUs on their way to and from the smsc
+func (r *SmppRoute) journalAddr() (string, error) {
+
+	r.closeJournalTap()
+	if r.journal == nil {
+		return r.settingAddress, nil
+	}
+
+	tap, err := r.journal.Tap(r.ID(), r.settingAddress, r.settingAddress, func(err error) {
+		r.log.WithError(err).Warn("could not record pdu to the journal")
+	})
+	if err != nil {
+		return "", err
+	}
+	r.journalTap = tap
+	return tap.Addr(), nil
+}
+
+func (r *SmppRoute) closeJournalTap() {
+	if r.journalTap != nil {
+		_ = r.journalTap.Close()
+		r.journalTap = nil
+	}
 }
 
 func (r *SmppRoute) startSmppConnection() error {
 
 	var connStat <-chan smpp.ConnStatus
 
+	addr, err := r.journalAddr()
+	if err != nil {
+		return err
+	}
+
 	switch r.settingBindType {
 
 	case "transmitter":
 
 		r.tr = &smpp.Transmitter{
-			Addr:       r.settingAddress,
+			Addr:       addr,
 			User:       r.settingUser,
 			Passwd:     r.settingPassword,
 			SystemType: r.settingSystemType,
@@ -250,7 +549,7 @@ func (r *SmppRoute) startSmppConnection() error {
 	default:
 
 		r.trx = &smpp.Transceiver{
-			Addr:       r.settingAddress,
+			Addr:       addr,
 			User:       r.settingUser,
 			Passwd:     r.settingPassword,
 			SystemType: r.settingSystemType,
@@ -263,21 +562,39 @@ func (r *SmppRoute) startSmppConnection() error {
 		break
 	}
 
+	return r.watchConnection(connStat)
+}
+
+// watchConnection follows the bind until the subroute is stopped or the
+// client closes the status channel on being closed
+func (r *SmppRoute) watchConnection(connStat <-chan smpp.ConnStatus) error {
+
 	for {
 		select {
 
-		case c := <-connStat:
+		case c, ok := <-connStat:
+			if !ok {
+				r.log.Info("Smsc connection was closed")
+				return nil
+			}
 
+			// A status can come with the error that caused it, both are recorded
 			if err := c.Error(); err != nil {
 				r.log.Warnf("Smsc connection has error : %v", err)
-				continue
+				r.stats.recordError(time.Now(), err)
 			}
 
 			r.log.Infof("Smsc updated status : %v", c.Status())
+			smscBound.WithLabelValues(r.ID(), r.settingAddress).Set(boolGauge(c.Status() == smpp.Connected))
+			r.stats.recordBind(time.Now(), c.Status())
 
 			switch c.Status() {
 			case smpp.Connected:
 
+				if r.isStopping() {
+					break
+				}
+
 				err := subscribeForMOEvents(r)
 				if err != nil {
 					r.log.Warnf("Error happened when initiating messages sending %v ", err)
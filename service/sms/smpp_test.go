@@ -0,0 +1,118 @@
+package sms
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"antinvestor.com/service/routep/utils"
+	"github.com/fiorix/go-smpp/smpp"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDrainWaitsForInFlightWork(t *testing.T) {
+
+	route := &SmppRoute{id: "test_smsc", stopping: make(chan struct{})}
+
+	release := make(chan struct{})
+	route.inFlight(func() {
+		<-release
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Error(t, route.Drain(ctx), "drain should give up at the deadline")
+
+	close(release)
+	assert.NoError(t, route.Drain(context.Background()))
+}
+
+func TestDrainCutsWebhookRetriesShort(t *testing.T) {
+
+	attempts := make(chan struct{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts <- struct{}{}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	queue := utils.NewMemoryQueue()
+	defer queue.Close()
+
+	log := logrus.NewEntry(logrus.New())
+	formatter, err := newWebhookFormatter("test_smsc", webhookFormatJSON, "")
+	assert.NoError(t, err)
+
+	workCtx, cancelWork := context.WithCancel(context.Background())
+	route := &SmppRoute{id: "test_smsc", log: log, stopping: make(chan struct{}), workCtx: workCtx, cancelWork: cancelWork}
+	deadLetters := newDeadLetterBox(queue, log, GetWebhookDeadLetterQueueName(route.ID()), time.Hour)
+	route.webhook = newWebhookDispatcher(log, route.ID(), &webhookClient{client: server.Client(), trustedHosts: []string{"127.0.0.1"}}, formatter,
+		[]time.Duration{time.Hour}, 5, "", deadLetters)
+
+	result := make(chan error, 1)
+	route.inFlight(func() {
+		result <- route.webhook.Dispatch(route.workContext(), webhookEventDLR, server.URL, &DLR{SmscID: "0a1b2c"}, "")
+	})
+	<-attempts
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Error(t, route.Drain(ctx))
+
+	select {
+	case err := <-result:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(2 * time.Second):
+		t.Fatal("webhook retries carried on after draining timed out")
+	}
+	assert.Empty(t, deadLetters.List(), "events cut short stay queued rather than dead lettered")
+}
+
+type connStatus struct {
+	status smpp.ConnStatusID
+	err    error
+}
+
+func (c connStatus) Status() smpp.ConnStatusID { return c.status }
+func (c connStatus) Error() error              { return c.err }
+
+func TestWatchConnectionReturnsOnClosedStatus(t *testing.T) {
+
+	route := &SmppRoute{id: "test_smsc", log: logrus.NewEntry(logrus.New()), stats: newRouteStats(),
+		stopping: make(chan struct{}), exitSignal: make(chan int, 1)}
+
+	connStat := make(chan smpp.ConnStatus)
+	close(connStat)
+
+	result := make(chan error, 1)
+	go func() { result <- route.watchConnection(connStat) }()
+
+	select {
+	case err := <-result:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("watching a closed connection never returned")
+	}
+}
+
+func TestWatchConnectionRecordsStatusesThatCarryErrors(t *testing.T) {
+
+	route := &SmppRoute{id: "test_smsc", log: logrus.NewEntry(logrus.New()), stats: newRouteStats(),
+		stopping: make(chan struct{}), exitSignal: make(chan int, 1), active: true}
+	route.stats.recordBind(time.Now(), smpp.Connected)
+
+	connStat := make(chan smpp.ConnStatus, 1)
+	connStat <- connStatus{status: smpp.Disconnected, err: errors.New("connection reset by peer")}
+	close(connStat)
+
+	assert.NoError(t, route.watchConnection(connStat))
+
+	status := route.Status()
+	assert.Equal(t, "disconnected", status.BindState)
+	assert.Equal(t, "connection reset by peer", status.LastError)
+	assert.False(t, route.IsActive())
+}
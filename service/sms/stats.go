@@ -0,0 +1,248 @@
+package sms
+
+import (
+	"fmt"
+	"github.com/fiorix/go-smpp/smpp"
+	"sync"
+	"time"
+)
+
+const (
+	// statsHistory is how many seconds of submits and dlrs a subroute keeps
+	statsHistory = 15 * 60
+	// statsTPSSpan is how far back the current tps of a subroute looks
+	statsTPSSpan = 10 * time.Second
+)
+
+// statsWindows are the spans route statistics are reported over
+var statsWindows = []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute}
+
+// RouteStatus is the live state of a route as seen by this replica
+type RouteStatus struct {
+	RouteID   string                 `json:"route_id"`
+	Active    bool                   `json:"active"`
+	SubRoutes []SubRouteStatus       `json:"subroutes"`
+	Windows   map[string]StatsWindow `json:"windows"`
+	Backlog   *Backlog               `json:"backlog,omitempty"`
+}
+
+// SubRouteStatus is the state of the bind to one smsc address
+type SubRouteStatus struct {
+	Address           string     `json:"address"`
+	BindState         string     `json:"bind_state"`
+	BoundSince        *time.Time `json:"bound_since,omitempty"`
+	BindUptimeSeconds float64    `json:"bind_uptime_seconds"`
+	LastError         string     `json:"last_error,omitempty"`
+	LastErrorAt       *time.Time `json:"last_error_at,omitempty"`
+	TPS               float64    `json:"tps"`
+
+	Windows map[string]StatsWindow `json:"windows"`
+}
+
+// StatsWindow sums up the submits and dlrs of a route over a span of time
+type StatsWindow struct {
+	Submits                  int64   `json:"submits"`
+	Failures                 int64   `json:"failures"`
+	DLRs                     int64   `json:"dlrs"`
+	DLRSuccessRatio          float64 `json:"dlr_success_ratio"`
+	AverageDLRLatencySeconds float64 `json:"average_dlr_latency_seconds"`
+
+	delivered int64
+	latency   time.Duration
+	latencies int64
+}
+
+func (w *StatsWindow) add(other StatsWindow) {
+	w.Submits += other.Submits
+	w.Failures += other.Failures
+	w.DLRs += other.DLRs
+	w.delivered += other.delivered
+	w.latency += other.latency
+	w.latencies += other.latencies
+
+	if w.DLRs > 0 {
+		w.DLRSuccessRatio = float64(w.delivered) / float64(w.DLRs)
+	}
+	if w.latencies > 0 {
+		w.AverageDLRLatencySeconds = (w.latency / time.Duration(w.latencies)).Seconds()
+	}
+}
+
+// statsBucket holds what happened on a subroute within one second
+type statsBucket struct {
+	second int64
+	window StatsWindow
+}
+
+// routeStats keeps a subroute's bind state and a rolling history of its
+// submits and dlrs, a nil routeStats records nothing
+type routeStats struct {
+	mu      sync.Mutex
+	buckets [statsHistory]statsBucket
+
+	bindState   string
+	boundSince  time.Time
+	lastError   string
+	lastErrorAt time.Time
+}
+
+func newRouteStats() *routeStats {
+	return &routeStats{bindState: "not_bound"}
+}
+
+// bucket returns the bucket of the second now falls in, the caller holds the lock
+func (s *routeStats) bucket(now time.Time) *statsBucket {
+	second := now.Unix()
+	bucket := &s.buckets[second%statsHistory]
+	if bucket.second != second {
+		*bucket = statsBucket{second: second}
+	}
+	return bucket
+}
+
+func (s *routeStats) recordSubmit(now time.Time, err error) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket := s.bucket(now)
+	bucket.window.Submits++
+	if err != nil {
+		bucket.window.Failures++
+		s.lastError, s.lastErrorAt = err.Error(), now
+	}
+}
+
+// recordDLR counts dlrs with a final status, submittedAt is zero when the
+// submit the dlr is for is not known
+func (s *routeStats) recordDLR(now time.Time, status DeliveryStatus, submittedAt time.Time) {
+	if s == nil {
+		return
+	}
+
+	switch status {
+	case DeliveryStatusDelivered, DeliveryStatusFailed, DeliveryStatusExpired, DeliveryStatusRejected:
+	default:
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket := s.bucket(now)
+	bucket.window.DLRs++
+	if status == DeliveryStatusDelivered {
+		bucket.window.delivered++
+	}
+	if !submittedAt.IsZero() && now.After(submittedAt) {
+		bucket.window.latency += now.Sub(submittedAt)
+		bucket.window.latencies++
+	}
+}
+
+func (s *routeStats) recordBind(now time.Time, status smpp.ConnStatusID) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch status {
+	case smpp.Connected:
+		if s.bindState != "connected" {
+			s.boundSince = now
+		}
+		s.bindState = "connected"
+	case smpp.Disconnected:
+		s.bindState = "disconnected"
+	case smpp.ConnectionFailed:
+		s.bindState = "connection_failed"
+	case smpp.BindFailed:
+		s.bindState = "bind_failed"
+	}
+
+	if status != smpp.Connected {
+		s.boundSince = time.Time{}
+	}
+}
+
+func (s *routeStats) recordError(now time.Time, err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastError, s.lastErrorAt = err.Error(), now
+}
+
+// window sums up the buckets of the span up to now
+func (s *routeStats) window(now time.Time, span time.Duration) StatsWindow {
+
+	var window StatsWindow
+	if s == nil {
+		return window
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	last := now.Unix()
+	first := last - int64(span/time.Second) + 1
+	for _, bucket := range s.buckets {
+		if bucket.second >= first && bucket.second <= last {
+			window.add(bucket.window)
+		}
+	}
+	return window
+}
+
+func (s *routeStats) status(now time.Time, address string) SubRouteStatus {
+
+	status := SubRouteStatus{Address: address, Windows: make(map[string]StatsWindow, len(statsWindows))}
+	for _, span := range statsWindows {
+		status.Windows[statsWindowName(span)] = s.window(now, span)
+	}
+	if s == nil {
+		return status
+	}
+
+	status.TPS = float64(s.window(now, statsTPSSpan).Submits) / statsTPSSpan.Seconds()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status.BindState = s.bindState
+	if !s.boundSince.IsZero() {
+		boundSince := s.boundSince
+		status.BoundSince = &boundSince
+		status.BindUptimeSeconds = now.Sub(boundSince).Seconds()
+	}
+	if s.lastError != "" {
+		lastErrorAt := s.lastErrorAt
+		status.LastError, status.LastErrorAt = s.lastError, &lastErrorAt
+	}
+	return status
+}
+
+func statsWindowName(span time.Duration) string {
+	return fmt.Sprintf("%dm", int(span.Minutes()))
+}
+
+// routeWindows sums up the windows of all of a route's subroutes
+func routeWindows(subRoutes []SubRouteStatus) map[string]StatsWindow {
+
+	windows := make(map[string]StatsWindow, len(statsWindows))
+	for _, span := range statsWindows {
+		var window StatsWindow
+		for _, subRoute := range subRoutes {
+			window.add(subRoute.Windows[statsWindowName(span)])
+		}
+		windows[statsWindowName(span)] = window
+	}
+	return windows
+}
@@ -0,0 +1,62 @@
+package sms
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fiorix/go-smpp/smpp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouteStatsWindows(t *testing.T) {
+
+	stats := newRouteStats()
+	now := time.Date(2023, 1, 15, 12, 30, 0, 0, time.UTC)
+
+	stats.recordBind(now.Add(-time.Hour), smpp.Connected)
+
+	// Older than the longest window
+	stats.recordSubmit(now.Add(-20*time.Minute), nil)
+
+	stats.recordSubmit(now.Add(-10*time.Minute), errors.New("throttled"))
+	stats.recordSubmit(now.Add(-3*time.Minute), nil)
+	stats.recordSubmit(now.Add(-2*time.Second), nil)
+	stats.recordSubmit(now, errors.New("invalid destination"))
+
+	stats.recordDLR(now.Add(-4*time.Minute), DeliveryStatusDelivered, now.Add(-5*time.Minute))
+	stats.recordDLR(now.Add(-30*time.Second), DeliveryStatusDelivered, now.Add(-40*time.Second))
+	stats.recordDLR(now.Add(-20*time.Second), DeliveryStatusFailed, time.Time{})
+	stats.recordDLR(now.Add(-10*time.Second), DeliveryStatusEnroute, now.Add(-20*time.Second))
+
+	status := stats.status(now, "localhost:2775")
+	assert.Equal(t, "connected", status.BindState)
+	assert.Equal(t, time.Hour.Seconds(), status.BindUptimeSeconds)
+	assert.Equal(t, "invalid destination", status.LastError)
+	assert.Equal(t, 0.2, status.TPS)
+
+	oneMinute := status.Windows["1m"]
+	assert.Equal(t, int64(2), oneMinute.Submits)
+	assert.Equal(t, int64(1), oneMinute.Failures)
+	assert.Equal(t, int64(2), oneMinute.DLRs)
+	assert.Equal(t, 0.5, oneMinute.DLRSuccessRatio)
+	assert.Equal(t, 10.0, oneMinute.AverageDLRLatencySeconds)
+
+	fiveMinutes := status.Windows["5m"]
+	assert.Equal(t, int64(3), fiveMinutes.Submits)
+	assert.Equal(t, int64(3), fiveMinutes.DLRs)
+	assert.Equal(t, 35.0, fiveMinutes.AverageDLRLatencySeconds)
+
+	fifteenMinutes := status.Windows["15m"]
+	assert.Equal(t, int64(4), fifteenMinutes.Submits)
+	assert.Equal(t, int64(2), fifteenMinutes.Failures)
+
+	stats.recordBind(now, smpp.Disconnected)
+	status = stats.status(now, "localhost:2775")
+	assert.Equal(t, "disconnected", status.BindState)
+	assert.Nil(t, status.BoundSince)
+
+	windows := routeWindows([]SubRouteStatus{status, status})
+	assert.Equal(t, int64(8), windows["15m"].Submits)
+	assert.InDelta(t, 2.0/3.0, windows["5m"].DLRSuccessRatio, 0.001)
+}
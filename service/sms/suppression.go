@@ -0,0 +1,227 @@
+package sms
+
+import (
+	"antinvestor.com/service/routep/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nuid"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrRecipientSuppressed is returned when sending to a number that opted out
+var ErrRecipientSuppressed = errors.New("recipient has opted out of messages from this sender")
+
+const (
+	suppressionActionReject = "reject"
+	suppressionActionDrop   = "drop"
+
+	// anyShortcode configures keywords that apply to every shortcode on a route
+	anyShortcode = "*"
+)
+
+// shortcodePolicy holds the keywords subscribers use to opt in or out of a
+// shortcode and what to reply to them with
+type shortcodePolicy struct {
+	OptOutKeywords []string `mapstructure:"opt_out_keywords"`
+	OptInKeywords  []string `mapstructure:"opt_in_keywords"`
+	OptOutReply    string   `mapstructure:"opt_out_reply"`
+	OptInReply     string   `mapstructure:"opt_in_reply"`
+}
+
+// Suppression records a subscriber opting out of, or back into, a shortcode
+type Suppression struct {
+	Shortcode  string    `json:"shortcode"`
+	MSISDN     string    `json:"msisdn"`
+	Suppressed bool      `json:"suppressed"`
+	Keyword    string    `json:"keyword,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// suppressionList tracks the numbers that opted out on a route. Changes are
+// published on the route's suppression subject and every replica replays the
+// full subject on start so consent survives restarts.
+type suppressionList struct {
+	routeID    string
+	action     string
+	shortcodes map[string]*shortcodePolicy
+	queue      utils.Queue
+	log        *logrus.Entry
+
+	mu         sync.RWMutex
+	suppressed map[string]bool
+
+	subscription utils.Subscription
+}
+
+func newSuppressionList(queue utils.Queue, log *logrus.Entry, routeID string) (*suppressionList, error) {
+
+	action := GetSetting(fmt.Sprintf("%s.opt_out.action", routeID), suppressionActionReject)
+	if action != suppressionActionReject && action != suppressionActionDrop {
+		return nil, fmt.Errorf("unsupported opt out action : %s", action)
+	}
+
+	shortcodes := make(map[string]*shortcodePolicy)
+	err := viper.UnmarshalKey(fmt.Sprintf("%s.opt_out.shortcodes", routeID), &shortcodes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &suppressionList{
+		routeID:    routeID,
+		action:     action,
+		shortcodes: shortcodes,
+		queue:      queue,
+		log:        log,
+		suppressed: make(map[string]bool),
+	}, nil
+}
+
+// normalizeShortcode drops the leading + some smscs put on shortcodes and msisdns
+func normalizeShortcode(shortcode string) string {
+	return strings.TrimPrefix(shortcode, "+")
+}
+
+func suppressionKey(shortcode string, msisdn string) string {
+	return fmt.Sprintf("%s|%s", normalizeShortcode(shortcode), normalizeShortcode(msisdn))
+}
+
+// IsSuppressed checks whether the recipient opted out of the sender
+func (l *suppressionList) IsSuppressed(from string, to string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.suppressed[suppressionKey(from, to)] || l.suppressed[suppressionKey(anyShortcode, to)]
+}
+
+// HandleKeyword updates the list if an inbound message is an opt in or opt out
+// keyword and returns the auto reply to send back if one is configured
+func (l *suppressionList) HandleKeyword(message *SMS) (*SMS, error) {
+
+	// Policies under anyShortcode hold the keywords for every shortcode but
+	// the opt out is still only from the shortcode that was messaged
+	shortcode := normalizeShortcode(message.To)
+	policy, ok := l.shortcodes[shortcode]
+	if !ok {
+		policy, ok = l.shortcodes[anyShortcode]
+		if !ok {
+			return nil, nil
+		}
+	}
+
+	keyword := firstKeyword(message.Data)
+
+	var reply string
+	suppression := &Suppression{
+		Shortcode: shortcode,
+		MSISDN:    message.From,
+		Keyword:   keyword,
+		CreatedAt: time.Now(),
+	}
+
+	switch {
+	case matchesKeyword(keyword, policy.OptOutKeywords):
+		suppression.Suppressed = true
+		reply = policy.OptOutReply
+	case matchesKeyword(keyword, policy.OptInKeywords):
+		suppression.Suppressed = false
+		reply = policy.OptInReply
+	default:
+		return nil, nil
+	}
+
+	err := l.publish(suppression)
+	if err != nil {
+		return nil, err
+	}
+
+	l.log.WithFields(message.logFields()).Infof("number %s opted %s of shortcode %s", utils.RedactMSISDN(message.From), map[bool]string{true: "out", false: "in"}[suppression.Suppressed], shortcode)
+
+	if reply == "" {
+		return nil, nil
+	}
+
+	return &SMS{
+		MessageID:     nuid.Next(),
+		From:          message.To,
+		To:            message.From,
+		Data:          reply,
+		RouteID:       message.RouteID,
+		Transactional: true,
+	}, nil
+}
+
+func (l *suppressionList) publish(suppression *Suppression) error {
+
+	binSuppression, err := json.Marshal(suppression)
+	if err != nil {
+		return err
+	}
+
+	l.index(suppression)
+	return l.queue.Publish(GetSuppressionQueueName(l.routeID), binSuppression)
+}
+
+func (l *suppressionList) index(suppression *Suppression) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := suppressionKey(suppression.Shortcode, suppression.MSISDN)
+	if suppression.Suppressed {
+		l.suppressed[key] = true
+	} else {
+		delete(l.suppressed, key)
+	}
+}
+
+func (l *suppressionList) start() error {
+
+	subs, err := l.queue.Subscribe(GetSuppressionQueueName(l.routeID), func(m utils.Msg) {
+
+		suppression := &Suppression{}
+		err := json.Unmarshal(m.Data(), suppression)
+		if err != nil {
+			l.log.WithError(err).Warnf("error decoding suppression : [ %v ] hence ignoring it", utils.RedactPayload(m.Data()))
+			return
+		}
+		l.index(suppression)
+
+	}, utils.DeliverAllAvailable())
+	if err != nil {
+		return err
+	}
+
+	l.subscription = subs
+	return nil
+}
+
+func (l *suppressionList) stop() {
+	if l.subscription != nil {
+		err := l.subscription.Close()
+		if err != nil {
+			l.log.WithError(err).Warn("failed to close suppression subscription")
+		}
+	}
+}
+
+// firstKeyword is the first word of a message in upper case without punctuation
+func firstKeyword(text string) string {
+	words := strings.Fields(text)
+	if len(words) == 0 {
+		return ""
+	}
+	return strings.ToUpper(strings.Trim(words[0], ".,!?;:\"'"))
+}
+
+func matchesKeyword(keyword string, keywords []string) bool {
+	for _, candidate := range keywords {
+		if strings.EqualFold(keyword, candidate) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package sms
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"antinvestor.com/service/routep/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDroppedMessagesAreAcked(t *testing.T) {
+
+	queue := utils.NewMemoryQueue()
+	defer queue.Close()
+
+	log := logrus.NewEntry(logrus.New())
+	suppressions := &suppressionList{routeID: "test_smsc", action: suppressionActionDrop, queue: queue, log: log,
+		suppressed: map[string]bool{suppressionKey("22140", "254700000001"): true}}
+
+	subRoute := &SmppRoute{id: "test_smsc", log: log, queue: queue, stopping: make(chan struct{})}
+	route := &Route{id: "test_smsc", queue: queue, suppressions: suppressions, subRoutes: []SubRoute{subRoute}}
+
+	acks := make(chan *ACK, 1)
+	subs, err := queue.Subscribe(GetSmsSendAckQueueName(route.ID()), func(m utils.Msg) {
+		messageAck := &ACK{}
+		assert.NoError(t, json.Unmarshal(m.Data(), messageAck))
+		acks <- messageAck
+	})
+	assert.NoError(t, err)
+	defer subs.Close()
+
+	ack, err := route.SendMOMessage(&SMS{MessageID: "m1", From: "22140", To: "254700000001", RouteID: route.ID()})
+	assert.NoError(t, err)
+	assert.Equal(t, AckStatusSuppressed, ack.SmscStatus)
+
+	select {
+	case messageAck := <-acks:
+		assert.Equal(t, "m1", messageAck.MessageID)
+		assert.Equal(t, AckStatusSuppressed, messageAck.SmscStatus)
+	case <-time.After(2 * time.Second):
+		t.Fatal("the suppressed ack never reached the ack queue")
+	}
+}
+
+func TestOptOutReplyHasMessageID(t *testing.T) {
+
+	queue := utils.NewMemoryQueue()
+	defer queue.Close()
+
+	suppressions := &suppressionList{routeID: "test_smsc", action: suppressionActionReject, queue: queue,
+		log: logrus.NewEntry(logrus.New()), suppressed: make(map[string]bool),
+		shortcodes: map[string]*shortcodePolicy{"22140": {OptOutKeywords: []string{"STOP"}, OptOutReply: "You have opted out"}}}
+
+	reply, err := suppressions.HandleKeyword(&SMS{From: "254700000001", To: "22140", Data: "stop", RouteID: "test_smsc"})
+	assert.NoError(t, err)
+	if assert.NotNil(t, reply) {
+		assert.NotEmpty(t, reply.MessageID, "auto replies need an id for their acks and dlrs to be tied back to")
+		assert.Equal(t, "254700000001", reply.To)
+	}
+}
+
+func TestWildcardKeywordsOnlyOptOutOfTheShortcodeMessaged(t *testing.T) {
+
+	queue := utils.NewMemoryQueue()
+	defer queue.Close()
+
+	suppressions := &suppressionList{routeID: "test_smsc", action: suppressionActionReject, queue: queue,
+		log: logrus.NewEntry(logrus.New()), suppressed: make(map[string]bool),
+		shortcodes: map[string]*shortcodePolicy{anyShortcode: {OptOutKeywords: []string{"STOP"}}}}
+
+	_, err := suppressions.HandleKeyword(&SMS{From: "254700000001", To: "22140", Data: "STOP", RouteID: "test_smsc"})
+	assert.NoError(t, err)
+
+	assert.True(t, suppressions.IsSuppressed("22140", "254700000001"))
+	assert.False(t, suppressions.IsSuppressed("22333", "254700000001"), "other senders can still reach the number")
+}
+
+func TestKeywordsToPlusPrefixedShortcodes(t *testing.T) {
+
+	queue := utils.NewMemoryQueue()
+	defer queue.Close()
+
+	suppressions := &suppressionList{routeID: "test_smsc", action: suppressionActionReject, queue: queue,
+		log: logrus.NewEntry(logrus.New()), suppressed: make(map[string]bool),
+		shortcodes: map[string]*shortcodePolicy{"22140": {OptOutKeywords: []string{"STOP"}}}}
+
+	_, err := suppressions.HandleKeyword(&SMS{From: "+254700000001", To: "+22140", Data: "STOP", RouteID: "test_smsc"})
+	assert.NoError(t, err)
+
+	assert.True(t, suppressions.IsSuppressed("22140", "254700000001"))
+	assert.True(t, suppressions.IsSuppressed("+22140", "+254700000001"))
+}
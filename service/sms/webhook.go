@@ -0,0 +1,207 @@
+package sms
+
+import (
+	"antinvestor.com/service/routep/utils"
+	"antinvestor.com/service/routep/webhook"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	webhookEventAck = "ack"
+	webhookEventDLR = "dlr"
+	webhookEventMT  = "mt"
+)
+
+// webhookDispatcher posts route events to client webhooks. Failed posts are
+// retried following the route's retry schedule and once the attempts run out
+// the event is dead lettered so it can be inspected and replayed later.
+// When the route has a webhook secret every request is signed.
+type webhookDispatcher struct {
+	routeID     string
+	log         *logrus.Entry
+	schedule    []time.Duration
+	maxAttempts int
+	secret      string
+	client      *webhookClient
+	formatter   *webhookFormatter
+	deadLetters *deadLetterBox
+}
+
+func newWebhookDispatcher(log *logrus.Entry, routeID string, client *webhookClient, formatter *webhookFormatter,
+	schedule []time.Duration, maxAttempts int, secret string, deadLetters *deadLetterBox) *webhookDispatcher {
+
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	return &webhookDispatcher{
+		routeID:     routeID,
+		log:         log,
+		schedule:    schedule,
+		maxAttempts: maxAttempts,
+		secret:      secret,
+		client:      client,
+		formatter:   formatter,
+		deadLetters: deadLetters,
+	}
+}
+
+// parseRetrySchedule reads a comma separated list of durations e.g. "10s,1m,5m"
+func parseRetrySchedule(schedule string) ([]time.Duration, error) {
+
+	var durations []time.Duration
+	for _, value := range strings.Split(schedule, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, err
+		}
+		durations = append(durations, duration)
+	}
+	return durations, nil
+}
+
+// backOff is the wait before the given retry, the last step of the schedule
+// is repeated once the schedule runs out
+func (d *webhookDispatcher) backOff(retry int) time.Duration {
+	if len(d.schedule) == 0 {
+		return 0
+	}
+	if retry >= len(d.schedule) {
+		return d.schedule[len(d.schedule)-1]
+	}
+	return d.schedule[retry]
+}
+
+// ackWait is how long a queued event may stay unacknowledged while the
+// dispatcher works through its retries
+func (d *webhookDispatcher) ackWait() time.Duration {
+
+	attemptTimeout := d.client.client.Timeout
+	if attemptTimeout <= 0 {
+		attemptTimeout = time.Minute
+	}
+
+	wait := attemptTimeout + time.Minute
+	for retry := 0; retry < d.maxAttempts-1; retry++ {
+		wait += d.backOff(retry) + attemptTimeout
+	}
+	return wait
+}
+
+// Dispatch delivers the payload to the url in the route's webhook format, on
+// giving up the event is dead lettered for replay onto the replaySubject. An
+// error is only returned if the event could neither be delivered nor dead lettered.
+func (d *webhookDispatcher) Dispatch(ctx context.Context, event string, url string, payload interface{}, replaySubject string) error {
+
+	if url == "" {
+		d.log.Warnf("no %s webhook is configured for route : %s hence dropping event", event, d.routeID)
+		return nil
+	}
+
+	binPayload, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	request, err := d.formatter.Format(event, url, payload)
+	if err != nil {
+		d.log.WithError(err).Warnf("could not format %s event for url : %s", event, url)
+	}
+
+	attempts := 0
+	for attempt := 1; request != nil && attempt <= d.maxAttempts; attempt++ {
+
+		attempts = attempt
+		sentAt := time.Now()
+		err = d.send(ctx, request)
+		webhookAttemptsTotal.WithLabelValues(d.routeID, event).Inc()
+		webhookDuration.WithLabelValues(d.routeID, event).Observe(time.Since(sentAt).Seconds())
+		if err == nil {
+			return nil
+		}
+		webhookFailuresTotal.WithLabelValues(d.routeID, event).Inc()
+
+		d.log.WithError(err).Infof("%s webhook attempt %d of %d failed on url : %s", event, attempt, d.maxAttempts, url)
+
+		if attempt < d.maxAttempts {
+			select {
+			case <-time.After(d.backOff(attempt - 1)):
+			case <-ctx.Done():
+			}
+		}
+
+		// Stopping, the event stays queued for another replica to deliver
+		if ctx.Err() != nil {
+			return fmt.Errorf("gave up on %s webhook after %d attempts : %w", event, attempt, ctx.Err())
+		}
+	}
+
+	deadLetterErr := d.deadLetters.Add(&DeadLetter{
+		RouteID:  d.routeID,
+		Event:    event,
+		Subject:  replaySubject,
+		URL:      url,
+		Payload:  binPayload,
+		Error:    err.Error(),
+		Attempts: attempts,
+	})
+	if deadLetterErr != nil {
+		d.log.WithError(deadLetterErr).Errorf("unable to dead letter %s event", event)
+		return err
+	}
+
+	d.log.WithError(err).Warnf("%s event dead lettered after %d attempts", event, attempts)
+	return nil
+}
+
+func (d *webhookDispatcher) send(ctx context.Context, request *webhookRequest) error {
+
+	req, err := http.NewRequestWithContext(ctx, request.Method, request.URL, bytes.NewBuffer(request.Body))
+	if err != nil {
+		return err
+	}
+	if request.ContentType != "" {
+		req.Header.Set("Content-Type", request.ContentType)
+	}
+	utils.InjectTraceHeaders(ctx, req.Header)
+
+	// Signatures prove requests came from the route so only trusted hosts get them
+	if d.secret != "" && d.client.trusts(req.URL) {
+		webhook.SignRequest(req, d.secret, request.Body, time.Now())
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	// Drain what is left of the body so the connection can be reused
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode >= http.StatusOK && resp.StatusCode < http.StatusNonAuthoritativeInfo {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return err
+	}
+
+	return fmt.Errorf("webhook responded with status : %d and content : %s", resp.StatusCode, string(body))
+}
@@ -0,0 +1,197 @@
+package sms
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// webhookClient is the http client a route uses for all its webhooks, it adds
+// the route's configured headers and credentials to requests for hosts the
+// route trusts. Requests for any other host go out without them.
+type webhookClient struct {
+	client            *http.Client
+	untrustedClient   *http.Client
+	headers           map[string]string
+	basicAuthUser     string
+	basicAuthPassword string
+	trustedHosts      []string
+}
+
+// newWebhookClient trusts the hosts of the route's configured webhook urls,
+// those in webhookUrls, and the hosts listed in webhook_allowed_hosts. An
+// allowed host starting with "*." covers its subdomains.
+func newWebhookClient(routeID string, webhookUrls ...string) (*webhookClient, error) {
+
+	timeout, err := time.ParseDuration(GetSetting(fmt.Sprintf("%s.webhook_timeout", routeID), "30s"))
+	if err != nil {
+		return nil, err
+	}
+
+	idleTimeout, err := time.ParseDuration(GetSetting(fmt.Sprintf("%s.webhook_idle_conn_timeout", routeID), "90s"))
+	if err != nil {
+		return nil, err
+	}
+
+	maxIdleConns, err := strconv.Atoi(GetSetting(fmt.Sprintf("%s.webhook_max_idle_conns", routeID), "100"))
+	if err != nil {
+		return nil, err
+	}
+
+	maxIdleConnsPerHost, err := strconv.Atoi(GetSetting(fmt.Sprintf("%s.webhook_max_idle_conns_per_host", routeID), "10"))
+	if err != nil {
+		return nil, err
+	}
+
+	maxConnsPerHost, err := strconv.Atoi(GetSetting(fmt.Sprintf("%s.webhook_max_conns_per_host", routeID), "50"))
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := webhookTLSConfig(routeID)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   10 * time.Second,
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		MaxConnsPerHost:       maxConnsPerHost,
+		IdleConnTimeout:       idleTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+
+	// The client certificate is only presented to trusted hosts
+	untrustedTransport := transport.Clone()
+	untrustedTransport.TLSClientConfig.Certificates = nil
+
+	webhookUrls = append(webhookUrls,
+		GetSetting(fmt.Sprintf("%s.sms_send_ack_url", routeID), ""),
+		GetSetting(fmt.Sprintf("%s.sms_send_dlr_url", routeID), ""),
+		GetSetting(fmt.Sprintf("%s.sms_receive_url", routeID), ""))
+
+	trustedHosts := viper.GetStringSlice(fmt.Sprintf("%s.webhook_allowed_hosts", routeID))
+	for _, webhookUrl := range webhookUrls {
+		parsedUrl, err := url.Parse(webhookUrl)
+		if err == nil && parsedUrl.Host != "" {
+			trustedHosts = append(trustedHosts, parsedUrl.Host)
+		}
+	}
+
+	return &webhookClient{
+		client: &http.Client{
+			Timeout:   timeout,
+			Transport: transport,
+		},
+		untrustedClient: &http.Client{
+			Timeout:   timeout,
+			Transport: untrustedTransport,
+		},
+		headers:           viper.GetStringMapString(fmt.Sprintf("%s.webhook_headers", routeID)),
+		basicAuthUser:     GetSetting(fmt.Sprintf("%s.webhook_basic_auth_user", routeID), ""),
+		basicAuthPassword: GetSetting(fmt.Sprintf("%s.webhook_basic_auth_password", routeID), ""),
+		trustedHosts:      trustedHosts,
+	}, nil
+}
+
+// trusts checks the url's host against the route's trusted hosts, a trusted
+// host without a port covers every port of the host
+func (c *webhookClient) trusts(target *url.URL) bool {
+
+	if target == nil || target.Host == "" {
+		return false
+	}
+
+	host := strings.ToLower(target.Host)
+	hostname := strings.ToLower(target.Hostname())
+	for _, trusted := range c.trustedHosts {
+		trusted = strings.ToLower(strings.TrimSpace(trusted))
+		switch {
+		case trusted == "":
+		case strings.HasPrefix(trusted, "*."):
+			if strings.HasSuffix(hostname, trusted[1:]) {
+				return true
+			}
+		case trusted == host || trusted == hostname:
+			return true
+		}
+	}
+	return false
+}
+
+// webhookTLSConfig loads the client certificate for mutual tls and any
+// private certificate authority the webhook servers use
+func webhookTLSConfig(routeID string) (*tls.Config, error) {
+
+	certFile := GetSetting(fmt.Sprintf("%s.webhook_tls_cert_file", routeID), "")
+	keyFile := GetSetting(fmt.Sprintf("%s.webhook_tls_key_file", routeID), "")
+	caFile := GetSetting(fmt.Sprintf("%s.webhook_tls_ca_file", routeID), "")
+
+	insecureSkipVerify, err := strconv.ParseBool(GetSetting(fmt.Sprintf("%s.webhook_tls_insecure_skip_verify", routeID), "false"))
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+
+	if certFile != "" || keyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	if caFile != "" {
+		caCert, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		certPool := x509.NewCertPool()
+		if !certPool.AppendCertsFromPEM(caCert) {
+			return nil, errors.New("no certificates could be read from the webhook ca file")
+		}
+		tlsConfig.RootCAs = certPool
+	}
+
+	return tlsConfig, nil
+}
+
+// Do sends the request with the route's headers and credentials added when
+// the request is for a trusted host
+func (c *webhookClient) Do(req *http.Request) (*http.Response, error) {
+
+	if !c.trusts(req.URL) {
+		if c.untrustedClient == nil {
+			return nil, fmt.Errorf("webhook host %s is not trusted by the route", req.URL.Host)
+		}
+		return c.untrustedClient.Do(req)
+	}
+
+	for key, value := range c.headers {
+		req.Header.Set(key, value)
+	}
+
+	if c.basicAuthUser != "" {
+		req.SetBasicAuth(c.basicAuthUser, c.basicAuthPassword)
+	}
+
+	return c.client.Do(req)
+}
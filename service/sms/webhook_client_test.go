@@ -0,0 +1,64 @@
+package sms
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookClientTrustedHosts(t *testing.T) {
+
+	client := &webhookClient{trustedHosts: []string{"hooks.example.com", "*.clients.example.com", "127.0.0.1:8443"}}
+
+	for rawUrl, trusted := range map[string]bool{
+		"https://hooks.example.com/dlr":          true,
+		"https://HOOKS.example.com:8443/dlr":     true,
+		"https://a.clients.example.com/dlr":      true,
+		"https://clients.example.com/dlr":        false,
+		"https://evilclients.example.com/dlr":    false,
+		"https://hooks.example.com.evil.io/dlr":  false,
+		"https://127.0.0.1:8443/dlr":             true,
+		"https://127.0.0.1:9443/dlr":             false,
+		"http://169.254.169.254/latest/metadata": false,
+	} {
+		parsedUrl, err := url.Parse(rawUrl)
+		assert.NoError(t, err)
+		assert.Equal(t, trusted, client.trusts(parsedUrl), rawUrl)
+	}
+}
+
+func TestWebhookClientKeepsCredentialsFromUntrustedHosts(t *testing.T) {
+
+	authorizations := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorizations <- r.Header.Get("Authorization") + r.Header.Get("X-Api-Key")
+	}))
+	defer server.Close()
+
+	client := &webhookClient{
+		client:            server.Client(),
+		untrustedClient:   server.Client(),
+		headers:           map[string]string{"X-Api-Key": "key"},
+		basicAuthUser:     "route",
+		basicAuthPassword: "secret",
+		trustedHosts:      []string{"hooks.example.com"},
+	}
+
+	req, err := http.NewRequest(http.MethodPost, server.URL, nil)
+	assert.NoError(t, err)
+	resp, err := client.Do(req)
+	assert.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Empty(t, <-authorizations)
+
+	client.trustedHosts = []string{"127.0.0.1"}
+	req, err = http.NewRequest(http.MethodPost, server.URL, nil)
+	assert.NoError(t, err)
+	resp, err = client.Do(req)
+	assert.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.NotEmpty(t, <-authorizations)
+}
@@ -0,0 +1,261 @@
+package sms
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/nats-io/nuid"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	webhookFormatJSON           = "json"
+	webhookFormatForm           = "form-urlencoded"
+	webhookFormatKannelTemplate = "kannel-template"
+	webhookFormatCloudEvents    = "cloudevents"
+)
+
+// webhookRequest is an event rendered in the format a webhook expects
+type webhookRequest struct {
+	Method      string
+	URL         string
+	ContentType string
+	Body        []byte
+}
+
+// webhookFormatter renders route events into webhook requests. Urls and the
+// optional body template are go templates over the event's json fields
+// e.g. https://example.com/dlr?id={{.message_id}}&status={{.smsc_status}}
+type webhookFormatter struct {
+	routeID      string
+	format       string
+	bodyTemplate *template.Template
+}
+
+func newWebhookFormatter(routeID string, format string, bodyTemplate string) (*webhookFormatter, error) {
+
+	switch format {
+	case "":
+		format = webhookFormatJSON
+	case webhookFormatJSON, webhookFormatForm, webhookFormatKannelTemplate, webhookFormatCloudEvents:
+	default:
+		return nil, fmt.Errorf("unsupported webhook format : %s", format)
+	}
+
+	formatter := &webhookFormatter{routeID: routeID, format: format}
+
+	if bodyTemplate != "" {
+		tmpl, err := template.New("body").Option("missingkey=zero").Parse(bodyTemplate)
+		if err != nil {
+			return nil, err
+		}
+		formatter.bodyTemplate = tmpl
+	}
+
+	return formatter, nil
+}
+
+// Format renders the event payload for delivery to the url
+func (f *webhookFormatter) Format(event string, rawUrl string, payload interface{}) (*webhookRequest, error) {
+
+	fields, err := webhookFields(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.format == webhookFormatKannelTemplate {
+		return &webhookRequest{
+			Method: http.MethodGet,
+			URL:    expandKannelTemplate(rawUrl, event, fields),
+		}, nil
+	}
+
+	webhookUrl, err := expandUrlTemplate(rawUrl, fields)
+	if err != nil {
+		return nil, err
+	}
+
+	request := &webhookRequest{Method: http.MethodPost, URL: webhookUrl}
+
+	switch f.format {
+	case webhookFormatForm:
+		values := url.Values{}
+		for key, value := range fields {
+			values.Set(key, value)
+		}
+		request.ContentType = "application/x-www-form-urlencoded"
+		request.Body = []byte(values.Encode())
+
+	case webhookFormatCloudEvents:
+		request.ContentType = "application/cloudevents+json"
+		request.Body, err = json.Marshal(map[string]interface{}{
+			"specversion":     "1.0",
+			"id":              nuid.Next(),
+			"source":          fmt.Sprintf("/routes/%s", f.routeID),
+			"type":            fmt.Sprintf("com.antinvestor.routep.%s", event),
+			"subject":         fields["message_id"],
+			"time":            time.Now().UTC().Format(time.RFC3339),
+			"datacontenttype": "application/json",
+			"data":            payload,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		request.ContentType = "application/json"
+		request.Body, err = json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if f.bodyTemplate != nil && f.format != webhookFormatCloudEvents {
+		var body bytes.Buffer
+		err = f.bodyTemplate.Execute(&body, fields)
+		if err != nil {
+			return nil, err
+		}
+		request.Body = body.Bytes()
+	}
+
+	return request, nil
+}
+
+// webhookFields flattens an event into its json field names and string values
+func webhookFields(payload interface{}) (map[string]string, error) {
+
+	binPayload, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var values map[string]interface{}
+	err = json.Unmarshal(binPayload, &values)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]string, len(values))
+	for key, value := range values {
+		switch v := value.(type) {
+		case string:
+			fields[key] = v
+		case nil:
+		default:
+			binValue, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			fields[key] = string(binValue)
+		}
+	}
+	return fields, nil
+}
+
+func expandUrlTemplate(rawUrl string, fields map[string]string) (string, error) {
+
+	if !strings.Contains(rawUrl, "{{") {
+		return rawUrl, nil
+	}
+
+	escaped := make(map[string]string, len(fields))
+	for key, value := range fields {
+		escaped[key] = url.QueryEscape(value)
+	}
+
+	tmpl, err := template.New("url").Option("missingkey=zero").Parse(rawUrl)
+	if err != nil {
+		return "", err
+	}
+
+	var expanded bytes.Buffer
+	err = tmpl.Execute(&expanded, escaped)
+	if err != nil {
+		return "", err
+	}
+	return expanded.String(), nil
+}
+
+// expandKannelTemplate substitutes the kannel style escape codes we can honour :
+// %p sender, %P receiver, %a and %b message text, %k keyword, %i smsc id,
+// %I and %F message id, %d dlr value, %A smsc reply, %t time and %T unix time
+func expandKannelTemplate(rawUrl string, event string, fields map[string]string) string {
+
+	text := fields["data"]
+	if text == "" {
+		text = fields["text"]
+	}
+
+	now := time.Now()
+	replacements := map[byte]string{
+		'p': fields["from"],
+		'P': fields["to"],
+		'a': text,
+		'b': text,
+		'k': fields["keyword"],
+		'i': fields["smsc_id"],
+		'I': fields["message_id"],
+		'F': fields["message_id"],
+		'd': kannelDLRValue(event, fields),
+		'A': fields["smsc_extra"],
+		't': now.Format("2006-01-02 15:04:05"),
+		'T': strconv.FormatInt(now.Unix(), 10),
+	}
+
+	var expanded strings.Builder
+	for i := 0; i < len(rawUrl); i++ {
+		if rawUrl[i] != '%' || i+1 >= len(rawUrl) {
+			expanded.WriteByte(rawUrl[i])
+			continue
+		}
+
+		if rawUrl[i+1] == '%' {
+			expanded.WriteByte('%')
+			i++
+			continue
+		}
+
+		replacement, ok := replacements[rawUrl[i+1]]
+		if !ok {
+			expanded.WriteByte(rawUrl[i])
+			continue
+		}
+		expanded.WriteString(url.QueryEscape(replacement))
+		i++
+	}
+	return expanded.String()
+}
+
+// kannelDLRValue maps an event onto kannel's dlr-mask values
+func kannelDLRValue(event string, fields map[string]string) string {
+
+	switch event {
+	case webhookEventAck:
+		if fields["smsc_id"] == "" {
+			return "16"
+		}
+		return "8"
+	case webhookEventDLR:
+		status := DeliveryStatus(fields["status"])
+		if status == "" {
+			status = defaultDLRStatuses[normalizeDLRStat(fields["smsc_status"])]
+		}
+		switch status {
+		case DeliveryStatusDelivered:
+			return "1"
+		case DeliveryStatusFailed, DeliveryStatusExpired, DeliveryStatusUnknown:
+			return "2"
+		case DeliveryStatusRejected:
+			return "16"
+		default:
+			return "4"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,129 @@
+package sms
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookFormats(t *testing.T) {
+
+	dlr := &DLR{From: "22333", To: "254700000001", RouteID: "test_smsc", SmscID: "0a1b2c", SmscStatus: "DELIVRD",
+		Status: DeliveryStatusDelivered, MessageID: "client 1", Metadata: map[string]string{"team": "otp"}}
+
+	for _, tc := range []struct {
+		name        string
+		format      string
+		template    string
+		url         string
+		method      string
+		contentType string
+		expectURL   string
+		expectBody  func(t *testing.T, body []byte)
+	}{
+		{
+			name: "json", format: webhookFormatJSON, url: "https://example.com/dlr",
+			method: http.MethodPost, contentType: "application/json", expectURL: "https://example.com/dlr",
+			expectBody: func(t *testing.T, body []byte) {
+				posted := &DLR{}
+				assert.NoError(t, json.Unmarshal(body, posted))
+				assert.Equal(t, dlr, posted)
+			},
+		},
+		{
+			name: "form", format: webhookFormatForm, url: "https://example.com/dlr",
+			method: http.MethodPost, contentType: "application/x-www-form-urlencoded", expectURL: "https://example.com/dlr",
+			expectBody: func(t *testing.T, body []byte) {
+				values, err := url.ParseQuery(string(body))
+				assert.NoError(t, err)
+				assert.Equal(t, "client 1", values.Get("message_id"))
+				assert.Equal(t, "DELIVRD", values.Get("smsc_status"))
+				assert.Equal(t, "delivered", values.Get("status"))
+				assert.Equal(t, `{"team":"otp"}`, values.Get("metadata"))
+				assert.NotContains(t, values, "sub", "empty fields are left out")
+			},
+		},
+		{
+			name: "url template", format: webhookFormatJSON, url: "https://example.com/dlr?id={{.message_id}}&status={{.smsc_status}}&none={{.missing}}",
+			method: http.MethodPost, contentType: "application/json", expectURL: "https://example.com/dlr?id=client+1&status=DELIVRD&none=",
+		},
+		{
+			name: "body template", format: webhookFormatJSON, template: "{{.message_id}}:{{.status}}", url: "https://example.com/dlr",
+			method: http.MethodPost, contentType: "application/json", expectURL: "https://example.com/dlr",
+			expectBody: func(t *testing.T, body []byte) {
+				assert.Equal(t, "client 1:delivered", string(body))
+			},
+		},
+		{
+			name: "kannel", format: webhookFormatKannelTemplate, url: "https://example.com/dlr?from=%p&to=%P&id=%I&smsc=%i&type=%d&pct=100%%&keep=%z",
+			method: http.MethodGet, expectURL: "https://example.com/dlr?from=22333&to=254700000001&id=client+1&smsc=0a1b2c&type=1&pct=100%&keep=%z",
+		},
+		{
+			name: "cloudevents", format: webhookFormatCloudEvents, template: "ignored", url: "https://example.com/dlr",
+			method: http.MethodPost, contentType: "application/cloudevents+json", expectURL: "https://example.com/dlr",
+			expectBody: func(t *testing.T, body []byte) {
+				var envelope struct {
+					SpecVersion string `json:"specversion"`
+					ID          string `json:"id"`
+					Source      string `json:"source"`
+					Type        string `json:"type"`
+					Subject     string `json:"subject"`
+					Time        string `json:"time"`
+					Data        *DLR   `json:"data"`
+				}
+				assert.NoError(t, json.Unmarshal(body, &envelope))
+				assert.Equal(t, "1.0", envelope.SpecVersion)
+				assert.NotEmpty(t, envelope.ID)
+				assert.NotEmpty(t, envelope.Time)
+				assert.Equal(t, "/routes/test_smsc", envelope.Source)
+				assert.Equal(t, "com.antinvestor.routep.dlr", envelope.Type)
+				assert.Equal(t, "client 1", envelope.Subject)
+				assert.Equal(t, dlr, envelope.Data)
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+
+			formatter, err := newWebhookFormatter("test_smsc", tc.format, tc.template)
+			assert.NoError(t, err)
+
+			request, err := formatter.Format(webhookEventDLR, tc.url, dlr)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.method, request.Method)
+			assert.Equal(t, tc.contentType, request.ContentType)
+			assert.Equal(t, tc.expectURL, request.URL)
+			if tc.expectBody != nil {
+				tc.expectBody(t, request.Body)
+			}
+		})
+	}
+
+	_, err := newWebhookFormatter("test_smsc", "xml", "")
+	assert.Error(t, err)
+
+	_, err = newWebhookFormatter("test_smsc", webhookFormatJSON, "{{.message_id")
+	assert.Error(t, err)
+}
+
+func TestKannelDLRValues(t *testing.T) {
+
+	for _, tc := range []struct {
+		event  string
+		fields map[string]string
+		value  string
+	}{
+		{webhookEventAck, map[string]string{"smsc_id": "0a1b2c"}, "8"},
+		{webhookEventAck, map[string]string{}, "16"},
+		{webhookEventDLR, map[string]string{"status": "delivered"}, "1"},
+		{webhookEventDLR, map[string]string{"status": "expired"}, "2"},
+		{webhookEventDLR, map[string]string{"status": "rejected"}, "16"},
+		{webhookEventDLR, map[string]string{"smsc_status": "UNDELIV"}, "2"},
+		{webhookEventDLR, map[string]string{"smsc_status": "ACCEPTD"}, "4"},
+		{webhookEventMT, map[string]string{}, ""},
+	} {
+		assert.Equal(t, tc.value, kannelDLRValue(tc.event, tc.fields), "%s %v", tc.event, tc.fields)
+	}
+}
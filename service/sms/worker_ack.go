@@ -1,16 +1,16 @@
 package sms
 
 import (
-	"bytes"
+	"antinvestor.com/service/routep/utils"
 	"encoding/json"
 	"fmt"
-	"github.com/nats-io/stan.go"
-	"io/ioutil"
-	"net/http"
-	"time"
 )
 
-func (r *SmppRoute) processAckEvent(messageAck *ACK, queue bool) error {
+func (r *SmppRoute) processAckEvent(messageAck *ACK, queue bool) (err error) {
+
+	ctx, span := utils.StartSpan(utils.ExtractTraceContext(r.workContext(), messageAck.TraceContext), "processAckEvent")
+	defer func() { utils.EndSpan(span, err) }()
+	messageAck.TraceContext = utils.InjectTraceContext(ctx)
 
 	message, err := json.Marshal(messageAck)
 	if err != nil {
@@ -21,34 +21,24 @@ func (r *SmppRoute) processAckEvent(messageAck *ACK, queue bool) error {
 		return r.queue.Publish(GetSmsSendAckQueueName(r.ID()), message)
 	}
 
-	r.log.Infof("Sending out ACK with ID : %s on url : %s", string(message), r.settingSmsSendAckUrl)
-
-	resp, err := http.Post(r.settingSmsSendAckUrl, "application/json", bytes.NewBuffer(message))
-	if err != nil {
-		r.log.WithError(err).Warnf("error occurred on attempting invoke webhook")
-		return err
+	ackUrl := r.settingSmsSendAckUrl
+	if messageAck.AckURL != "" {
+		ackUrl = messageAck.AckURL
 	}
 
-	if resp.StatusCode >= http.StatusOK && resp.StatusCode < http.StatusNonAuthoritativeInfo {
-		return nil
-	} else {
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			r.log.WithError(err).Infof(" reschedule ACK message with status : %d ", resp.StatusCode)
-		} else {
-			r.log.Infof(" reschedule ACK message with status : %d and content : %v", resp.StatusCode, string(body))
-		}
-	}
+	r.log.WithFields(messageAck.logFields()).Infof("Sending out ACK with status : %s on url : %s", messageAck.SmscStatus, ackUrl)
 
-	return nil
+	payload := *messageAck
+	payload.AckURL = ""
+	payload.QueueID = ""
+	payload.TraceContext = nil
+	return r.webhook.Dispatch(ctx, webhookEventAck, ackUrl, &payload, GetSmsSendAckQueueName(r.ID()))
 }
 
 func subscribeForAckEvents(r *SmppRoute) error {
 
-	aw, _ := time.ParseDuration("60s")
-
 	if r.sendAckSubscription != nil {
-		err := r.sendAckSubscription.Unsubscribe()
+		err := r.sendAckSubscription.Close()
 		if err != nil {
 			r.log.WithError(err).Warn("failed to unsubscribe for send ack events")
 		}
@@ -57,23 +47,24 @@ func subscribeForAckEvents(r *SmppRoute) error {
 	}
 
 	// Async Subscriber to acknowledge messages queued on smsc
-	subs, err := r.queue.QueueSubscribe(GetSmsSendAckQueueName(r.ID()), GetQueueGroup(r.ID()), func(m *stan.Msg) {
+	subs, err := r.queue.QueueSubscribe(GetSmsSendAckQueueName(r.ID()), GetQueueGroup(r.ID()), func(m utils.Msg) {
 
-		go func() {
+		r.inFlight(func() {
 
 			messageAck := &ACK{}
-			err := json.Unmarshal(m.Data, messageAck)
+			err := json.Unmarshal(m.Data(), messageAck)
 			if err != nil {
-				r.log.WithError(err).Errorf("error decoding message : [ %v  ] hence dropping it", m.Data)
-				err = m.Ack()
-				if err != nil{
-					r.log.WithError(err).Error("error acknowledging message")
-				}
+				r.log.WithError(err).Errorf("error decoding message : [ %v  ] hence dead lettering it", utils.RedactPayload(m.Data()))
+				r.deadLetterMessage(messageEventAck, m, err)
+				return
 			}
 
 			err = r.processAckEvent(messageAck, false)
 			if err != nil {
 				r.log.WithError(err).Errorf("error occurred when posting ack to webhook")
+				if r.isPoison(m) {
+					r.deadLetterMessage(messageEventAck, m, err)
+				}
 			} else {
 
 				err = m.Ack()
@@ -82,10 +73,10 @@ func subscribeForAckEvents(r *SmppRoute) error {
 				}
 			}
 
-		}()
+		})
 
-	}, stan.StartWithLastReceived(), stan.DurableName(fmt.Sprintf("%s_send_ack", r.ID())),
-		stan.SetManualAckMode(), stan.AckWait(aw), stan.MaxInflight(50))
+	}, utils.StartWithLastReceived(), utils.DurableName(fmt.Sprintf("%s_send_ack", r.ID())),
+		utils.SetManualAckMode(), utils.AckWait(r.webhook.ackWait()), utils.MaxInflight(50))
 
 	if err != nil {
 		return err
@@ -1,23 +1,26 @@
 package sms
 
 import (
-	"bytes"
+	"antinvestor.com/service/routep/utils"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/fiorix/go-smpp/smpp/pdu/pdufield"
-	"github.com/nats-io/stan.go"
-	"io/ioutil"
-	"net/http"
-	"regexp"
-	"time"
+	"github.com/fiorix/go-smpp/smpp/pdu/pdutlv"
 )
 
-func (r *SmppRoute) processDLRMessage(dlr *DLR, queue bool) error {
+func (r *SmppRoute) processDLRMessage(dlr *DLR, queue bool) (err error) {
+
+	if !r.receipts.Enrich(dlr) {
+		r.log.Infof("no receipt found for dlr with smsc id : %s", dlr.SmscID)
+	}
+
+	ctx, span := utils.StartSpan(utils.ExtractTraceContext(r.workContext(), dlr.TraceContext), "processDLRMessage")
+	defer func() { utils.EndSpan(span, err) }()
+	dlr.TraceContext = utils.InjectTraceContext(ctx)
 
 	dlrMessage, err := json.Marshal(dlr)
 	if err != nil {
-		r.log.Errorf("Could not encode sms : %v hence dropping it", dlr)
+		r.log.WithFields(dlr.logFields()).Errorf("Could not encode dlr hence dropping it")
 		return nil
 	}
 
@@ -25,77 +28,36 @@ func (r *SmppRoute) processDLRMessage(dlr *DLR, queue bool) error {
 
 		err := r.queue.Publish(GetSmsSendDLRQueueName(dlr.RouteID), dlrMessage)
 		if err != nil {
-			r.log.WithError(err).Errorf("unable to queue DLR %v hence just lost it", dlr)
+			r.log.WithError(err).WithFields(dlr.logFields()).Errorf("unable to queue DLR hence just lost it")
 		}
 		return nil
 	}
 
-	r.log.Infof("Sending out DLR : %s on url : %s", string(dlrMessage), r.settingSmsSendDLRUrl)
-
-	resp, err := http.Post(r.settingSmsSendDLRUrl, "application/json", bytes.NewBuffer(dlrMessage))
-	if err != nil {
-		r.log.WithError(err).Warnf("error occurred on attempting dlr webhook")
-		return err
+	dlrUrl := r.settingSmsSendDLRUrl
+	if dlr.DLRURL != "" {
+		dlrUrl = dlr.DLRURL
 	}
 
-	if resp.StatusCode >= http.StatusOK && resp.StatusCode < http.StatusNonAuthoritativeInfo {
-		return nil
-	} else {
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return err
-		} else {
-			return errors.New(string(body))
-		}
-	}
+	r.log.WithFields(dlr.logFields()).Infof("Sending out DLR with status : %s (%s) on url : %s", dlr.Status, dlr.SmscStatus, dlrUrl)
 
+	payload := *dlr
+	payload.DLRURL = ""
+	payload.TraceContext = nil
+	return r.webhook.Dispatch(ctx, webhookEventDLR, dlrUrl, &payload, GetSmsSendDLRQueueName(r.ID()))
 }
 
-func (r *SmppRoute) parseForDlr(fields pdufield.Map) *DLR {
+func (r *SmppRoute) parseForDlr(fields pdufield.Map, tlvs pdutlv.Map) *DLR {
 
-	dlrText := fields[pdufield.ShortMessage].String()
-
-	dlr := &DLR{
-		From:      fields[pdufield.SourceAddr].String(),
-		To:        fields[pdufield.DestinationAddr].String(),
-		SmscID:    fields[pdufield.SMDefaultMsgID].String(),
-		SmscExtra: dlrText,
-	}
-
-	regex := regexp.MustCompile(`id:(?P<id>.*) sub:(?P<sub>.*) dlvrd:(?P<dlvrd>.*) submit date:(?P<submitdate>.*) done date:(?P<donedate>.*) stat:(?P<stat>.*) err:(?P<err>.*) text:(?P<text>.*)`)
-	match := regex.FindStringSubmatch(dlrText)
-
-	for i, name := range match {
-		switch regex.SubexpNames()[i] {
-		case "id":
-			dlr.SmscID = name
-		case "sub":
-			dlr.Sub = name
-		case "dlvrd":
-			dlr.Dlvrd = name
-		case "submitdate":
-			dlr.SubmittedDate = name
-		case "donedate":
-			dlr.DoneDate = name
-		case "stat":
-			dlr.SmscStatus = name
-		case "err":
-			dlr.Err = name
-		case "text":
-			dlr.Err = name
-
-		}
-	}
+	dlr := parseDLR(fields, tlvs, r.settingDLRTimezone)
+	dlr.Status, dlr.ErrorCategory = r.dlrStatuses.classify(dlr.SmscStatus, dlr.Err)
 
 	return dlr
 }
 
 func subscribeForDLREvents(r *SmppRoute) error {
 
-	aw, _ := time.ParseDuration("60s")
-
 	if r.receiveDLRSubscription != nil {
-		err := r.receiveDLRSubscription.Unsubscribe()
+		err := r.receiveDLRSubscription.Close()
 		if err != nil {
 			r.log.WithError(err).Warn("failed to unsubscribe for dlr events")
 		}
@@ -103,23 +65,24 @@ func subscribeForDLREvents(r *SmppRoute) error {
 	}
 
 	// Async Subscriber to acknowledge messages queued on smsc
-	subs, err := r.queue.QueueSubscribe(GetSmsSendDLRQueueName(r.ID()), GetQueueGroup(r.ID()), func(m *stan.Msg) {
+	subs, err := r.queue.QueueSubscribe(GetSmsSendDLRQueueName(r.ID()), GetQueueGroup(r.ID()), func(m utils.Msg) {
 
-		go func() {
+		r.inFlight(func() {
 
 			messageDlr := &DLR{}
-			err := json.Unmarshal(m.Data, messageDlr)
+			err := json.Unmarshal(m.Data(), messageDlr)
 			if err != nil {
-				r.log.WithError(err).Errorf("error decoding message : [ %v  ] hence dropping it", m.Data)
-				err = m.Ack()
-				if err != nil {
-					r.log.WithError(err).Error("error acknowledging message")
-				}
+				r.log.WithError(err).Errorf("error decoding message : [ %v  ] hence dead lettering it", utils.RedactPayload(m.Data()))
+				r.deadLetterMessage(messageEventDLR, m, err)
+				return
 			}
 
 			err = r.processDLRMessage(messageDlr, false)
 			if err != nil {
 				r.log.WithError(err).Errorf("error occurred when posting dlr to webhook")
+				if r.isPoison(m) {
+					r.deadLetterMessage(messageEventDLR, m, err)
+				}
 			} else {
 				err = m.Ack()
 				if err != nil {
@@ -127,10 +90,10 @@ func subscribeForDLREvents(r *SmppRoute) error {
 				}
 			}
 
-		}()
+		})
 
-	}, stan.StartWithLastReceived(), stan.DurableName(fmt.Sprintf("%s_receive_dlr", r.ID())),
-		stan.SetManualAckMode(), stan.AckWait(aw), stan.MaxInflight(50))
+	}, utils.StartWithLastReceived(), utils.DurableName(fmt.Sprintf("%s_receive_dlr", r.ID())),
+		utils.SetManualAckMode(), utils.AckWait(r.webhook.ackWait()), utils.MaxInflight(50))
 
 	if err != nil {
 		return err
@@ -0,0 +1,56 @@
+package sms
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"antinvestor.com/service/routep/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueuedDLRIsEnrichedAndPosted(t *testing.T) {
+
+	received := make(chan *DLR, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dlr := &DLR{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(dlr))
+		received <- dlr
+	}))
+	defer server.Close()
+
+	queue := utils.NewMemoryQueue()
+	defer queue.Close()
+
+	log := logrus.NewEntry(logrus.New())
+	formatter, err := newWebhookFormatter("test_smsc", webhookFormatJSON, "")
+	assert.NoError(t, err)
+
+	route := &SmppRoute{
+		id:                   "test_smsc",
+		log:                  log,
+		queue:                queue,
+		receipts:             newReceiptStore(queue, log, "test_smsc", time.Hour),
+		settingSmsSendDLRUrl: server.URL,
+	}
+	route.webhook = newWebhookDispatcher(log, route.ID(), &webhookClient{client: server.Client(), trustedHosts: []string{"127.0.0.1"}}, formatter,
+		nil, 1, "", newDeadLetterBox(queue, log, GetWebhookDeadLetterQueueName(route.ID()), time.Hour))
+
+	assert.NoError(t, route.receipts.Put(&Receipt{SmscID: "0a1b2c", MessageID: "client-1", Metadata: map[string]string{"team": "otp"}}))
+	assert.NoError(t, subscribeForDLREvents(route))
+
+	assert.NoError(t, route.processDLRMessage(&DLR{SmscID: "0A1B2C", RouteID: route.ID(), SmscStatus: "DELIVRD", DLRURL: server.URL + "/dlr"}, true))
+
+	select {
+	case dlr := <-received:
+		assert.Equal(t, "client-1", dlr.MessageID)
+		assert.Equal(t, "otp", dlr.Metadata["team"])
+		assert.Equal(t, "DELIVRD", dlr.SmscStatus)
+		assert.Empty(t, dlr.DLRURL, "the client's own webhook url is not posted back to it")
+	case <-time.After(2 * time.Second):
+		t.Fatal("dlr was not posted to the webhook")
+	}
+}
@@ -1,18 +1,22 @@
 package sms
 
 import (
+	"antinvestor.com/service/routep/utils"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/fiorix/go-smpp/smpp"
 	"github.com/fiorix/go-smpp/smpp/pdu/pdufield"
 	"github.com/fiorix/go-smpp/smpp/pdu/pdutext"
 	"github.com/fiorix/go-smpp/smpp/pdu/pdutlv"
-	"github.com/nats-io/stan.go"
 	"time"
 )
 
 func (r *SmppRoute) SendMOMessage(message *SMS) (*ACK, error) {
 
+	ctx, span := utils.StartSpan(utils.ExtractTraceContext(context.Background(), message.TraceContext), "Submit")
+	traceContext := utils.InjectTraceContext(ctx)
+
 	var dlrLvl pdufield.DeliverySetting
 	switch r.settingDLRLevel{
 	case 2:
@@ -45,16 +49,25 @@ func (r *SmppRoute) SendMOMessage(message *SMS) (*ACK, error) {
 		To: message.To,
 		RouteID: message.RouteID,
 		MessageID: message.MessageID,
+		AckURL:    message.AckURL,
+		QueueID:   message.QueueID,
+
+		TraceContext: traceContext,
 	}
 
 	var sm *smpp.ShortMessage
 	var err error
 
+	submittedAt := time.Now()
 	if r.trx != nil {
 		sm, err = r.trx.Submit(&sms)
 	} else {
 		sm, err = r.tr.Submit(&sms)
 	}
+	submitDuration.WithLabelValues(r.ID(), r.settingAddress).Observe(time.Since(submittedAt).Seconds())
+	submitsTotal.WithLabelValues(r.ID(), r.settingAddress, submitStatus(err)).Inc()
+	r.stats.recordSubmit(time.Now(), err)
+	utils.EndSpan(span, err)
 
 	if err != nil{
 		return &ack, err
@@ -62,7 +75,22 @@ func (r *SmppRoute) SendMOMessage(message *SMS) (*ACK, error) {
 
 	if sm != nil {
 		ack.SmscID = sm.RespID()
-		ack.SmscStatus = "Submitted"
+		ack.SmscStatus = AckStatusSubmitted
+
+		err = r.receipts.Put(&Receipt{
+			SmscID:    ack.SmscID,
+			MessageID: message.MessageID,
+			RouteID:   message.RouteID,
+			From:      message.From,
+			To:        message.To,
+			Metadata:  message.Metadata,
+			DLRURL:    message.DLRURL,
+
+			TraceContext: traceContext,
+		})
+		if err != nil {
+			r.log.WithError(err).WithFields(message.logFields()).Warnf("could not share receipt for message with id : %s", message.MessageID)
+		}
 	}
 	return &ack, nil
 
@@ -70,19 +98,86 @@ func (r *SmppRoute) SendMOMessage(message *SMS) (*ACK, error) {
 
 func unSubscribeForMOEvents(route *SmppRoute) error {
 
-	if route.sendSubscription != nil {
-		err := route.sendSubscription.Unsubscribe()
-		route.sendSubscription = nil
-		return err
+	if route.sendScheduler != nil {
+		route.sendScheduler.Stop()
+		route.sendScheduler = nil
+	}
+
+	// Closing keeps the durables so sending resumes from where it stopped on rebinding
+	var err error
+	for _, subscription := range route.sendSubscriptions {
+		unsubscribeErr := subscription.Close()
+		if unsubscribeErr != nil {
+			err = unsubscribeErr
+		}
+	}
+	route.sendSubscriptions = nil
+	return err
+}
+
+// processQueuedMessage submits a message taken off one of the send lanes
+func (r *SmppRoute) processQueuedMessage(m utils.Msg) {
+
+	message := &SMS{}
+	err := json.Unmarshal(m.Data(), message)
+	if err != nil {
+		r.log.WithError(err).Errorf("error decoding message : [ %v  ] hence dead lettering it", utils.RedactPayload(m.Data()))
+		r.deadLetterMessage(messageEventSend, m, err)
+		return
+	}
+
+	if message.IsExpired() {
+		r.log.WithFields(message.logFields()).Infof("dropping message with id : %s as it expired at : %v", message.MessageID, message.ExpiresAt)
+
+		err = r.processAckEvent(&ACK{
+			From:       message.From,
+			To:         message.To,
+			MessageID:  message.MessageID,
+			RouteID:    message.RouteID,
+			SmscStatus: AckStatusExpired,
+			AckURL:     message.AckURL,
+			QueueID:    message.QueueID,
+
+			TraceContext: message.TraceContext,
+		}, r.CanQueue())
+		if err != nil {
+			r.log.WithError(err).WithFields(message.logFields()).Infof("failed to process expiry ack for %s", message.MessageID)
+			return
+		}
+
+		err = m.Ack()
+		if err != nil {
+			r.log.WithError(err).Warn("error occurred on attempting acknowledge expired MO")
+		}
+		return
+	}
+
+	messageAck, err := r.SendMOMessage(message)
+	if err != nil {
+		if r.isPoison(m) {
+			r.log.WithFields(message.logFields()).Infof("giving up on message with id : %s after %d attempts because : %v", message.MessageID, m.RedeliveryCount()+1, err)
+			r.deadLetterMessage(messageEventSend, m, err)
+			return
+		}
+		r.log.WithFields(message.logFields()).Infof("rescheduling message with id : %s for later because : %v", message.MessageID, err)
+		return
+	}
+
+	err = r.processAckEvent(messageAck, r.CanQueue())
+	if err != nil {
+		r.log.WithError(err).WithFields(messageAck.logFields()).Infof("failed to process ack %s hence dropping it because : %v", messageAck.MessageID, err)
+	}
+	err = m.Ack()
+	if err != nil {
+		r.log.WithError(err).Warn("error occurred on attempting acknowledge successful MO")
 	}
-	return nil
 }
 
 func subscribeForMOEvents(r *SmppRoute) error {
 
 	aw, _ := time.ParseDuration("60s")
 
-	if r.sendSubscription != nil {
+	if r.sendSubscriptions != nil {
 		if r.IsActive() {
 			return nil
 		} else {
@@ -90,44 +185,42 @@ func subscribeForMOEvents(r *SmppRoute) error {
 		}
 	}
 
-	// Async Subscriber to send queued messages
-	subs, err := r.queue.QueueSubscribe(GetSmsSendQueueName(r.ID()), GetQueueGroup(r.ID()), func(m *stan.Msg) {
+	scheduler := newLaneScheduler(int(r.settingSmsCDeliveryRate), r.settingNormalPriorityWeight,
+		r.settingBulkPriorityWeight, func(m utils.Msg, done func()) {
+			r.inFlight(func() {
+				defer done()
+				r.processQueuedMessage(m)
+			})
+		})
 
-		go func() {
-			message := &SMS{}
-			err := json.Unmarshal(m.Data, message)
-			if err != nil {
-				r.log.WithError(err).Errorf("error decoding message : [ %v  ] hence dropping it", m.Data)
-				err = m.Ack()
-				if err != nil{
-					r.log.WithError(err).Error("error acknowledging message")
-				}
-			}
+	for _, priority := range Priorities {
+		lane := priority
 
-			messageAck, err := r.SendMOMessage(message)
-			if err != nil {
-				r.log.Infof("rescheduling message with id : %s for later because : %v", message.MessageID, err)
-				return
-			}
+		durableName := fmt.Sprintf("%s_send_sub", r.ID())
+		if lane != PriorityNormal {
+			durableName = fmt.Sprintf("%s_send_%s_sub", r.ID(), lane)
+		}
 
-			err = r.processAckEvent(messageAck, r.CanQueue())
-			if err != nil {
-				r.log.WithError(err).Infof("failed to process ack %s hence dropping it because : %v", messageAck.MessageID, err)
-			}
-			err = m.Ack()
-			if err != nil {
-				r.log.WithError(err).Warn("error occurred on attempting acknowledge successful MO")
-			}
+		// Async Subscriber to send queued messages
+		subs, err := r.queue.QueueSubscribe(GetSmsSendPriorityQueueName(r.ID(), lane), GetQueueGroup(r.ID()), func(m utils.Msg) {
+			scheduler.Enqueue(lane, m)
+		}, utils.StartWithLastReceived(), utils.DurableName(durableName),
+			utils.SetManualAckMode(), utils.AckWait(aw), utils.MaxInflight(int(r.settingSmsCDeliveryRate)))
 
-		}()
-	}, stan.StartWithLastReceived(), stan.DurableName(fmt.Sprintf("%s_send_sub", r.ID())),
-		stan.SetManualAckMode(), stan.AckWait(aw), stan.MaxInflight(int(r.settingSmsCDeliveryRate)))
+		if err != nil {
+			scheduler.Stop()
+			for _, subscription := range r.sendSubscriptions {
+				_ = subscription.Close()
+			}
+			r.sendSubscriptions = nil
+			return err
+		}
 
-	if err != nil {
-		return err
+		r.sendSubscriptions = append(r.sendSubscriptions, subs)
 	}
 
-	r.sendSubscription = subs
+	r.sendScheduler = scheduler
+	go scheduler.Run()
 
 	return nil
 }
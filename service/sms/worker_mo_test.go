@@ -0,0 +1,190 @@
+package sms
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"antinvestor.com/service/routep/utils"
+	"github.com/fiorix/go-smpp/smpp"
+	"github.com/fiorix/go-smpp/smpp/pdu"
+	"github.com/fiorix/go-smpp/smpp/pdu/pdufield"
+	"github.com/fiorix/go-smpp/smpp/smpptest"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// newSubmittingRoute binds a queued route to a test smsc that fails the
+// first failures submits it gets and accepts the rest
+func newSubmittingRoute(t *testing.T, queue utils.Queue, failures int32) (*SmppRoute, *int32) {
+
+	var submits int32
+	server := smpptest.NewUnstartedServer()
+	server.Handler = func(c smpptest.Conn, p pdu.Body) {
+		if p.Header().ID != pdu.SubmitSMID {
+			return
+		}
+
+		resp := pdu.NewSubmitSMResp()
+		resp.Header().Seq = p.Header().Seq
+		if atomic.AddInt32(&submits, 1) <= failures {
+			resp.Header().Status = pdu.Status(0x45)
+		} else {
+			_ = resp.Fields().Set(pdufield.MessageID, "0a1b2c")
+		}
+		_ = c.Write(resp)
+	}
+	server.Start()
+	t.Cleanup(server.Close)
+
+	log := logrus.NewEntry(logrus.New())
+	route := &SmppRoute{
+		id:                     "test_smsc",
+		log:                    log,
+		queue:                  queue,
+		receipts:               newReceiptStore(queue, log, "test_smsc", time.Hour),
+		messageDeadLetters:     newDeadLetterBox(queue, log, GetSmsDeadLetterQueueName("test_smsc"), time.Hour),
+		stats:                  newRouteStats(),
+		settingAddress:         server.Addr(),
+		settingMaxRedeliveries: 1,
+		stopping:               make(chan struct{}),
+	}
+
+	route.trx = &smpp.Transceiver{Addr: server.Addr(), User: smpptest.DefaultUser, Passwd: smpptest.DefaultPasswd}
+	select {
+	case c := <-route.trx.Bind():
+		assert.Equal(t, smpp.Connected, c.Status())
+	case <-time.After(5 * time.Second):
+		t.Fatal("never bound to the test smsc")
+	}
+	t.Cleanup(func() { _ = route.trx.Close() })
+
+	return route, &submits
+}
+
+// consumeSendLane hands messages on the send lane to the route until the test ends
+func consumeSendLane(t *testing.T, route *SmppRoute) {
+	subs, err := route.queue.QueueSubscribe(GetSmsSendQueueName(route.ID()), GetQueueGroup(route.ID()),
+		route.processQueuedMessage, utils.SetManualAckMode(), utils.AckWait(100*time.Millisecond))
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = subs.Close() })
+}
+
+func subscribeAcks(t *testing.T, queue utils.Queue) chan *ACK {
+	acks := make(chan *ACK, 10)
+	subs, err := queue.Subscribe(GetSmsSendAckQueueName("test_smsc"), func(m utils.Msg) {
+		messageAck := &ACK{}
+		assert.NoError(t, json.Unmarshal(m.Data(), messageAck))
+		acks <- messageAck
+	})
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = subs.Close() })
+	return acks
+}
+
+func publishSMS(t *testing.T, queue utils.Queue, message *SMS) {
+	data, err := json.Marshal(message)
+	assert.NoError(t, err)
+	assert.NoError(t, queue.Publish(GetSmsSendQueueName("test_smsc"), data))
+}
+
+func TestUndecodableMessagesAreDeadLettered(t *testing.T) {
+
+	queue := utils.NewMemoryQueue()
+	defer queue.Close()
+
+	route, submits := newSubmittingRoute(t, queue, 0)
+	consumeSendLane(t, route)
+
+	assert.NoError(t, queue.Publish(GetSmsSendQueueName(route.ID()), []byte("not json")))
+
+	assert.Eventually(t, func() bool { return len(route.messageDeadLetters.List()) == 1 }, 2*time.Second, 10*time.Millisecond)
+	deadLetter := route.messageDeadLetters.List()[0]
+	assert.Equal(t, messageEventSend, deadLetter.Event)
+	assert.Equal(t, GetSmsSendQueueName(route.ID()), deadLetter.Subject)
+	assert.Equal(t, "not json", string(deadLetter.Payload))
+	assert.Equal(t, 1, deadLetter.Attempts)
+
+	time.Sleep(300 * time.Millisecond)
+	assert.Len(t, route.messageDeadLetters.List(), 1, "dead lettered messages are acknowledged")
+	assert.Zero(t, atomic.LoadInt32(submits))
+}
+
+func TestMessagesFailingPastTheRedeliveryLimitAreDeadLettered(t *testing.T) {
+
+	queue := utils.NewMemoryQueue()
+	defer queue.Close()
+
+	route, submits := newSubmittingRoute(t, queue, 10)
+	acks := subscribeAcks(t, queue)
+	consumeSendLane(t, route)
+
+	publishSMS(t, queue, &SMS{MessageID: "m1", From: "22333", To: "254700000001", Data: "Hello", RouteID: route.ID()})
+
+	assert.Eventually(t, func() bool { return len(route.messageDeadLetters.List()) == 1 }, 2*time.Second, 10*time.Millisecond)
+	deadLetter := route.messageDeadLetters.List()[0]
+	assert.Equal(t, 2, deadLetter.Attempts)
+	assert.NotEmpty(t, deadLetter.Error)
+
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(submits), "the message is not retried once dead lettered")
+	assert.Empty(t, acks)
+}
+
+func TestMessagesSentOnRetryAreNotDeadLettered(t *testing.T) {
+
+	queue := utils.NewMemoryQueue()
+	defer queue.Close()
+
+	route, submits := newSubmittingRoute(t, queue, 1)
+	acks := subscribeAcks(t, queue)
+	consumeSendLane(t, route)
+
+	publishSMS(t, queue, &SMS{MessageID: "m1", From: "22333", To: "254700000001", Data: "Hello", RouteID: route.ID()})
+
+	select {
+	case messageAck := <-acks:
+		assert.Equal(t, "m1", messageAck.MessageID)
+		assert.Equal(t, AckStatusSubmitted, messageAck.SmscStatus)
+		assert.Equal(t, "0a1b2c", messageAck.SmscID)
+	case <-time.After(2 * time.Second):
+		t.Fatal("the retried message was never acked")
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	assert.Empty(t, route.messageDeadLetters.List())
+	assert.Equal(t, int32(2), atomic.LoadInt32(submits))
+}
+
+func TestExpiredMessagesAreAckedWithoutBeingSubmitted(t *testing.T) {
+
+	queue := utils.NewMemoryQueue()
+	defer queue.Close()
+
+	route, submits := newSubmittingRoute(t, queue, 0)
+	acks := subscribeAcks(t, queue)
+	consumeSendLane(t, route)
+
+	expiredAt := time.Now().Add(-time.Minute)
+	publishSMS(t, queue, &SMS{MessageID: "m1", From: "22333", To: "254700000001", Data: "Your code is 1234",
+		RouteID: route.ID(), ExpiresAt: &expiredAt, QueueID: "q1"})
+
+	select {
+	case messageAck := <-acks:
+		assert.Equal(t, "m1", messageAck.MessageID)
+		assert.Equal(t, "q1", messageAck.QueueID)
+		assert.Equal(t, AckStatusExpired, messageAck.SmscStatus)
+		assert.Empty(t, messageAck.SmscID)
+	case <-time.After(2 * time.Second):
+		t.Fatal("the expired message was never acked")
+	}
+
+	select {
+	case messageAck := <-acks:
+		t.Fatalf("expired message was processed again : %v", messageAck.SmscStatus)
+	case <-time.After(300 * time.Millisecond):
+	}
+	assert.Zero(t, atomic.LoadInt32(submits), "expired messages are never submitted")
+	assert.Empty(t, route.messageDeadLetters.List())
+}
@@ -1,21 +1,20 @@
 package sms
 
 import (
-	"bytes"
+	"antinvestor.com/service/routep/utils"
 	"encoding/json"
 	"fmt"
-	"github.com/nats-io/stan.go"
-	"github.com/pkg/errors"
-	"io/ioutil"
-	"net/http"
-	"time"
 )
 
-func (r *SmppRoute) processMTMessage(message *SMS, queue bool) error {
+func (r *SmppRoute) processMTMessage(message *SMS, queue bool) (err error) {
+
+	ctx, span := utils.StartSpan(utils.ExtractTraceContext(r.workContext(), message.TraceContext), "processMTMessage")
+	defer func() { utils.EndSpan(span, err) }()
+	message.TraceContext = utils.InjectTraceContext(ctx)
 
 	respMessage, err := json.Marshal(message)
 	if err != nil {
-		r.log.Errorf("Could not encode sms : %v hence dropping it", message)
+		r.log.WithFields(message.logFields()).Errorf("Could not encode sms hence dropping it")
 		return nil
 	}
 
@@ -23,25 +22,34 @@ func (r *SmppRoute) processMTMessage(message *SMS, queue bool) error {
 		return r.queue.Publish(GetSmsReceiveQueueName(message.RouteID), respMessage)
 	}
 
-	r.log.Infof("Sending out MT : %s on url : %s", string(respMessage), r.settingSmsReceiveUrl)
+	receiveUrl := r.settingSmsReceiveUrl
 
-	resp, err := http.Post(r.settingSmsReceiveUrl, "application/json", bytes.NewBuffer(respMessage))
-	if err != nil {
-		return err
-	}
+	rule, keyword := matchInboundRule(r.inboundRules, message)
+	if rule != nil {
+		message.Keyword = keyword
 
-	if resp.StatusCode >= http.StatusOK && resp.StatusCode < http.StatusNonAuthoritativeInfo {
-		return nil
-	} else {
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return err
-		} else {
-			return errors.New(string(body))
+		if rule.Subject != "" {
+			respMessage, err = json.Marshal(message)
+			if err != nil {
+				r.log.WithFields(message.logFields()).Errorf("Could not encode sms hence dropping it")
+				return nil
+			}
+
+			r.log.WithFields(message.logFields()).Infof("Routing MT from : %s to subject : %s", utils.RedactMSISDN(message.From), rule.Subject)
+			return r.queue.Publish(rule.Subject, respMessage)
 		}
+
+		receiveUrl = rule.URL
 	}
 
+	r.log.WithFields(message.logFields()).Infof("Sending out MT from : %s on url : %s", utils.RedactMSISDN(message.From), receiveUrl)
 
+	payload := *message
+	payload.AckURL = ""
+	payload.DLRURL = ""
+	payload.QueueID = ""
+	payload.TraceContext = nil
+	return r.webhook.Dispatch(ctx, webhookEventMT, receiveUrl, &payload, GetSmsReceiveQueueName(r.ID()))
 }
 
 
@@ -49,10 +57,8 @@ func (r *SmppRoute) processMTMessage(message *SMS, queue bool) error {
 
 func subscribeForMTEvents(r *SmppRoute) error {
 
-	aw, _ := time.ParseDuration("60s")
-
 	if r.receiveMessageSubscription != nil {
-		err := r.receiveMessageSubscription.Unsubscribe()
+		err := r.receiveMessageSubscription.Close()
 		if err != nil {
 			r.log.WithError(err).Warn("failed to unsubscribe for mt events")
 		}
@@ -61,23 +67,24 @@ func subscribeForMTEvents(r *SmppRoute) error {
 	}
 
 	// Async Subscriber to acknowledge messages queued on smsc
-	subs, err := r.queue.QueueSubscribe(GetSmsReceiveQueueName(r.ID()), GetQueueGroup(r.ID()), func(m *stan.Msg) {
+	subs, err := r.queue.QueueSubscribe(GetSmsReceiveQueueName(r.ID()), GetQueueGroup(r.ID()), func(m utils.Msg) {
 
-		go func() {
+		r.inFlight(func() {
 
 			message := SMS{}
-			err := json.Unmarshal(m.Data, &message)
+			err := json.Unmarshal(m.Data(), &message)
 			if err != nil {
-				r.log.WithError(err).Errorf("error decoding message : [ %v  ] hence dropping it", m.Data)
-				err = m.Ack()
-				if err != nil {
-					r.log.WithError(err).Error("error acknowledging message")
-				}
+				r.log.WithError(err).Errorf("error decoding message : [ %v  ] hence dead lettering it", utils.RedactPayload(m.Data()))
+				r.deadLetterMessage(messageEventReceive, m, err)
+				return
 			}
 
 			err = r.processMTMessage(&message, false)
 			if err != nil {
-				r.log.WithError(err).Errorf("error occurred when posting dlr to webhook")
+				r.log.WithError(err).Errorf("error occurred when posting inbound message to webhook")
+				if r.isPoison(m) {
+					r.deadLetterMessage(messageEventReceive, m, err)
+				}
 			} else {
 				err = m.Ack()
 				if err != nil {
@@ -86,10 +93,10 @@ func subscribeForMTEvents(r *SmppRoute) error {
 			}
 
 
-		}()
+		})
 
-	}, stan.StartWithLastReceived(), stan.DurableName(fmt.Sprintf("%s_receive_mt", r.ID())),
-		stan.SetManualAckMode(), stan.AckWait(aw), stan.MaxInflight(50))
+	}, utils.StartWithLastReceived(), utils.DurableName(fmt.Sprintf("%s_receive_mt", r.ID())),
+		utils.SetManualAckMode(), utils.AckWait(r.webhook.ackWait()), utils.MaxInflight(50))
 
 	if err != nil {
 		return err
@@ -1,8 +1,11 @@
 package utils
 
 import (
+	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -30,11 +33,30 @@ func ConfigureLogging(appService string) (*logrus.Entry, error) {
 		logrus.SetLevel(level)
 	}
 
-	// always use the fulltimestamp
-	logrus.SetFormatter(&logrus.TextFormatter{
-		FullTimestamp:    true,
-		DisableTimestamp: false,
-	})
+	switch strings.ToLower(GetEnv("LOG_FORMAT", "text")) {
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{
+			TimestampFormat: time.RFC3339Nano,
+		})
+	case "text":
+		// always use the fulltimestamp
+		logrus.SetFormatter(&logrus.TextFormatter{
+			FullTimestamp:    true,
+			DisableTimestamp: false,
+		})
+	default:
+		return nil, fmt.Errorf("unsupported log format : %s", GetEnv("LOG_FORMAT", ""))
+	}
+
+	redactMSISDN, err := strconv.ParseBool(GetEnv("LOG_REDACT_MSISDN", "true"))
+	if err != nil {
+		return nil, err
+	}
+	redactText, err := strconv.ParseBool(GetEnv("LOG_REDACT_TEXT", "true"))
+	if err != nil {
+		return nil, err
+	}
+	SetRedaction(Redaction{MSISDN: redactMSISDN, Text: redactText})
 
 	return logrus.StandardLogger().WithField("hostname",
 		hostname).WithField("service", appService), nil
@@ -2,76 +2,172 @@ package utils
 
 import (
 	"fmt"
-	"github.com/nats-io/nats.go"
-	"github.com/nats-io/stan.go"
 	"github.com/sirupsen/logrus"
+	"strings"
 	"time"
 )
 
-// ConfigureQueue StanQueue Access for environment is configured here
-func ConfigureQueue(log *logrus.Entry) (stan.Conn, error) {
-
-	queueURL := GetEnv("QUEUE_URL", nats.DefaultURL)
-
-	// Connect to a server
-	nc, err := nats.Connect(queueURL,
-		nats.ReconnectBufSize(50*1024*1024), nats.ReconnectWait(1*time.Second),
-		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
-			log.Infof("queue got disconnected! Reason: %q", err)
-		}),
-		nats.ReconnectHandler(func(nc *nats.Conn) {
-			log.Infof("queue got reconnected to %v!\n", nc.ConnectedUrl())
-		}),
-		nats.ClosedHandler(func(nc *nats.Conn) {
-			log.Infof("queue connection closed. Reason: %q\n", nc.LastError())
-		}))
-
-	if err != nil {
-		return nil,  err
-	}
+const (
+	// QueueBackendStan keeps messages on a NATS streaming cluster
+	QueueBackendStan = "stan"
+	// QueueBackendJetStream keeps messages on NATS JetStream
+	QueueBackendJetStream = "jetstream"
+	// QueueBackendMemory keeps messages in process, QUEUE_URL=mem:// also selects it
+	QueueBackendMemory = "mem"
+	// QueueBackendKafka keeps messages on Kafka, QUEUE_URL=kafka://host:port also selects it
+	QueueBackendKafka = "kafka"
+)
 
-	stanQueue, err := NewQue(log, nc)
-	if err != nil {
-		return nil,  err
-	}
+// Msg is a message delivered to a queue subscription
+type Msg interface {
+	Subject() string
+	Data() []byte
+	// ID identifies the message on its subject, it is the same on every redelivery
+	ID() string
+	// Redelivered is true if this is not the first time the message was delivered
+	Redelivered() bool
+	// RedeliveryCount is how many times the message was delivered before this one
+	RedeliveryCount() int
+	Ack() error
+}
 
-	return stanQueue.connection, nil
+// MsgHandler is called for every message a subscription receives
+type MsgHandler func(m Msg)
+
+// Subscription is an active interest in a subject
+type Subscription interface {
+	// Unsubscribe removes the subscription, on backends where a durable belongs
+	// to one subscriber its state goes too
+	Unsubscribe() error
+	// Close stops the subscription, durable subscriptions resume on resubscribing
+	Close() error
+}
+
+// Queue is the messaging backend the routes publish to and consume from
+type Queue interface {
+	Publish(subject string, data []byte) error
+	// Subscribe delivers every message on the subject to this subscriber
+	Subscribe(subject string, handler MsgHandler, options ...SubscriptionOption) (Subscription, error)
+	// QueueSubscribe shares the messages on the subject between the members of the group
+	QueueSubscribe(subject string, group string, handler MsgHandler, options ...SubscriptionOption) (Subscription, error)
+	// IsConnected reports whether the backend is reachable for publishing and consuming
+	IsConnected() bool
+	Close() error
 }
 
+// StartPosition is where a new subscription starts receiving messages from
+type StartPosition int
 
-// StanQueue implements the "ICheckable" interface,
-// this is our gateway to health checking
-type StanQueue struct {
-	connection stan.Conn
-	log *logrus.Entry
-	disconnected bool
+const (
+	StartNewOnly StartPosition = iota
+	StartLastReceived
+	StartAllAvailable
+	StartTimeDelta
+)
+
+// SubscriptionOptions are the settings queue implementations subscribe with
+type SubscriptionOptions struct {
+	DurableName    string
+	AckWait        time.Duration
+	MaxInflight    int
+	ManualAcks     bool
+	StartAt        StartPosition
+	StartTimeDelta time.Duration
 }
 
-func(q *StanQueue) ConnectionLostListener(conn stan.Conn, reason error) {
-	q.log.Errorf("Connection lost, reason: %v", reason)
-	q.disconnected = true
+// SubscriptionOption configures a subscription
+type SubscriptionOption func(*SubscriptionOptions)
+
+// DefaultSubscriptionOptions are used unless overridden by options
+func DefaultSubscriptionOptions() SubscriptionOptions {
+	return SubscriptionOptions{
+		AckWait:     30 * time.Second,
+		MaxInflight: 1024,
+		StartAt:     StartNewOnly,
+	}
 }
 
+func applySubscriptionOptions(options []SubscriptionOption) SubscriptionOptions {
+	subOptions := DefaultSubscriptionOptions()
+	for _, option := range options {
+		option(&subOptions)
+	}
+	return subOptions
+}
+
+// DurableName keeps the subscription's position when it is closed
+func DurableName(name string) SubscriptionOption {
+	return func(o *SubscriptionOptions) {
+		o.DurableName = name
+	}
+}
 
-func NewQue(log *logrus.Entry, conn *nats.Conn) (*StanQueue, error) {
+// AckWait is how long before an unacknowledged message is redelivered
+func AckWait(wait time.Duration) SubscriptionOption {
+	return func(o *SubscriptionOptions) {
+		o.AckWait = wait
+	}
+}
 
-	clusterID := GetEnv("QUEUE_CLUSTER_ID", "smpp_cluster")
-	clientID := GetEnv("QUEUE_CLIENT_ID", fmt.Sprintf("smpp_router", ))
+// MaxInflight limits the messages delivered but not yet acknowledged
+func MaxInflight(max int) SubscriptionOption {
+	return func(o *SubscriptionOptions) {
+		o.MaxInflight = max
+	}
+}
 
-	stanQueue := StanQueue{
-		log: log,
-		disconnected: false,
+// SetManualAckMode requires handlers to acknowledge messages themselves
+func SetManualAckMode() SubscriptionOption {
+	return func(o *SubscriptionOptions) {
+		o.ManualAcks = true
 	}
+}
 
-	stanConnection, err := stan.Connect(clusterID, clientID, stan.NatsConn(conn),
-		stan.Pings(10, 5),
-		stan.SetConnectionLostHandler(stanQueue.ConnectionLostListener))
+// StartWithLastReceived starts from the last message published on the subject
+func StartWithLastReceived() SubscriptionOption {
+	return func(o *SubscriptionOptions) {
+		o.StartAt = StartLastReceived
+	}
+}
 
-	if err != nil {
-		return nil, err
+// DeliverAllAvailable starts from the first message still kept on the subject
+func DeliverAllAvailable() SubscriptionOption {
+	return func(o *SubscriptionOptions) {
+		o.StartAt = StartAllAvailable
 	}
+}
 
-	stanQueue.connection = stanConnection
-	return &stanQueue, nil
+// StartAtTimeDelta starts from messages published within the given duration
+func StartAtTimeDelta(ago time.Duration) SubscriptionOption {
+	return func(o *SubscriptionOptions) {
+		o.StartAt = StartTimeDelta
+		o.StartTimeDelta = ago
+	}
 }
 
+// ConfigureQueue Queue Access for environment is configured here, QUEUE_BACKEND
+// picks the implementation used
+func ConfigureQueue(log *logrus.Entry) (Queue, error) {
+
+	backend := GetEnv("QUEUE_BACKEND", QueueBackendStan)
+	queueURL := GetEnv("QUEUE_URL", "")
+	if strings.HasPrefix(queueURL, "mem://") {
+		backend = QueueBackendMemory
+	} else if strings.HasPrefix(queueURL, "kafka://") {
+		backend = QueueBackendKafka
+	}
+
+	switch backend {
+	case QueueBackendMemory:
+		log.Warn("using the in memory queue, queued messages will be lost when the service stops")
+		return NewMemoryQueue(), nil
+	case QueueBackendStan:
+		return NewStanQueue(log)
+	case QueueBackendJetStream:
+		return NewJetStreamQueue(log)
+	case QueueBackendKafka:
+		return NewKafkaQueue(log)
+	default:
+		return nil, fmt.Errorf("unsupported queue backend : %s", backend)
+	}
+}
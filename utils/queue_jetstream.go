@@ -0,0 +1,277 @@
+package utils
+
+import (
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var invalidStreamNameCharacters = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// JetStreamQueue keeps messages on NATS JetStream. Subjects are stored on a
+// stream per subject prefix e.g. test_smsc.message.send is kept on the
+// TEST_SMSC stream which is created covering test_smsc.> if it is missing.
+type JetStreamQueue struct {
+	connection *nats.Conn
+	jetStream  nats.JetStreamContext
+	log        *logrus.Entry
+
+	streamMaxAge time.Duration
+	streams      sync.Map
+}
+
+// NewJetStreamQueue connects to a JetStream enabled NATS server
+func NewJetStreamQueue(log *logrus.Entry) (*JetStreamQueue, error) {
+
+	streamMaxAge, err := time.ParseDuration(GetEnv("QUEUE_STREAM_MAX_AGE", "0s"))
+	if err != nil {
+		return nil, err
+	}
+
+	nc, err := connectNats(log)
+	if err != nil {
+		return nil, err
+	}
+
+	jetStream, err := nc.JetStream()
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	return &JetStreamQueue{
+		connection:   nc,
+		jetStream:    jetStream,
+		log:          log,
+		streamMaxAge: streamMaxAge,
+	}, nil
+}
+
+// ensureStream makes sure a stream captures the subject before it is used
+func (q *JetStreamQueue) ensureStream(subject string) error {
+
+	prefix := strings.SplitN(subject, ".", 2)[0]
+	if _, ok := q.streams.Load(prefix); ok {
+		return nil
+	}
+
+	_, err := q.jetStream.StreamNameBySubject(subject)
+	if err == nil {
+		q.streams.Store(prefix, true)
+		return nil
+	}
+	if err != nats.ErrNoMatchingStream {
+		return err
+	}
+
+	streamName := strings.ToUpper(invalidStreamNameCharacters.ReplaceAllString(prefix, "_"))
+	_, err = q.jetStream.AddStream(&nats.StreamConfig{
+		Name:     streamName,
+		Subjects: []string{prefix + ".>"},
+		MaxAge:   q.streamMaxAge,
+		Storage:  nats.FileStorage,
+	})
+	if err != nil && err != nats.ErrStreamNameAlreadyInUse {
+		return err
+	}
+
+	q.log.Infof("queue stream %s created for subjects %s.>", streamName, prefix)
+	q.streams.Store(prefix, true)
+	return nil
+}
+
+func (q *JetStreamQueue) Publish(subject string, data []byte) error {
+
+	err := q.ensureStream(subject)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.jetStream.Publish(subject, data)
+	return err
+}
+
+func (q *JetStreamQueue) Subscribe(subject string, handler MsgHandler, options ...SubscriptionOption) (Subscription, error) {
+	return q.QueueSubscribe(subject, "", handler, options...)
+}
+
+func (q *JetStreamQueue) QueueSubscribe(subject string, group string, handler MsgHandler, options ...SubscriptionOption) (Subscription, error) {
+
+	err := q.ensureStream(subject)
+	if err != nil {
+		return nil, err
+	}
+
+	subOptions := applySubscriptionOptions(options)
+
+	config := &nats.ConsumerConfig{
+		Durable:       subOptions.DurableName,
+		DeliverGroup:  group,
+		FilterSubject: subject,
+		AckWait:       subOptions.AckWait,
+		MaxAckPending: subOptions.MaxInflight,
+		AckPolicy:     nats.AckNonePolicy,
+	}
+
+	if subOptions.ManualAcks {
+		config.AckPolicy = nats.AckExplicitPolicy
+	}
+
+	switch subOptions.StartAt {
+	case StartLastReceived:
+		config.DeliverPolicy = nats.DeliverLastPolicy
+	case StartAllAvailable:
+		config.DeliverPolicy = nats.DeliverAllPolicy
+	case StartTimeDelta:
+		startTime := time.Now().Add(-subOptions.StartTimeDelta)
+		config.DeliverPolicy = nats.DeliverByStartTimePolicy
+		config.OptStartTime = &startTime
+	default:
+		config.DeliverPolicy = nats.DeliverNewPolicy
+	}
+
+	jsOptions := []nats.SubOpt{nats.AckWait(config.AckWait), nats.MaxAckPending(config.MaxAckPending)}
+	if subOptions.ManualAcks {
+		jsOptions = append(jsOptions, nats.ManualAck())
+	} else {
+		jsOptions = append(jsOptions, nats.AckNone())
+	}
+
+	if subOptions.DurableName != "" {
+		// The library deletes consumers it created itself when the subscription
+		// goes, durables are shared by every replica so they are created here and
+		// bound to instead
+		stream, err := q.ensureConsumer(subject, config)
+		if err != nil {
+			return nil, err
+		}
+		jsOptions = []nats.SubOpt{nats.Bind(stream, subOptions.DurableName), nats.ManualAck()}
+	} else {
+		jsOptions = append(jsOptions, jetStreamDeliverOption(config))
+	}
+
+	callback := func(m *nats.Msg) {
+		handler(&jetStreamMsg{m})
+	}
+
+	var subscription *nats.Subscription
+	if group == "" {
+		subscription, err = q.jetStream.Subscribe(subject, callback, jsOptions...)
+	} else {
+		subscription, err = q.jetStream.QueueSubscribe(subject, group, callback, jsOptions...)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &jetStreamSubscription{subscription}, nil
+}
+
+// ensureConsumer creates the durable consumer unless it exists already, the
+// consumer keeps its position for as long as the stream is kept
+func (q *JetStreamQueue) ensureConsumer(subject string, config *nats.ConsumerConfig) (string, error) {
+
+	stream, err := q.jetStream.StreamNameBySubject(subject)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = q.jetStream.ConsumerInfo(stream, config.Durable)
+	if err == nil {
+		return stream, nil
+	}
+	if err != nats.ErrConsumerNotFound {
+		return "", err
+	}
+
+	config.DeliverSubject = nats.NewInbox()
+	_, err = q.jetStream.AddConsumer(stream, config)
+	if err != nil && err != nats.ErrConsumerNameAlreadyInUse {
+		return "", err
+	}
+
+	q.log.Infof("queue consumer %s created on stream %s", config.Durable, stream)
+	return stream, nil
+}
+
+func jetStreamDeliverOption(config *nats.ConsumerConfig) nats.SubOpt {
+	switch config.DeliverPolicy {
+	case nats.DeliverLastPolicy:
+		return nats.DeliverLast()
+	case nats.DeliverAllPolicy:
+		return nats.DeliverAll()
+	case nats.DeliverByStartTimePolicy:
+		return nats.StartTime(*config.OptStartTime)
+	default:
+		return nats.DeliverNew()
+	}
+}
+
+// IsConnected is true while the nats connection is up, consumers resume by themselves on reconnecting
+func (q *JetStreamQueue) IsConnected() bool {
+	return q.connection.IsConnected()
+}
+
+func (q *JetStreamQueue) Close() error {
+	err := q.connection.Drain()
+	if err != nil {
+		q.connection.Close()
+	}
+	return err
+}
+
+type jetStreamSubscription struct {
+	subscription *nats.Subscription
+}
+
+// Unsubscribe stops delivery, durable consumers are shared by every replica
+// so they are left in place
+func (s *jetStreamSubscription) Unsubscribe() error {
+	return s.subscription.Unsubscribe()
+}
+
+// Close stops delivery once the messages already received are handled, durable
+// consumers are left in place
+func (s *jetStreamSubscription) Close() error {
+	return s.subscription.Drain()
+}
+
+type jetStreamMsg struct {
+	msg *nats.Msg
+}
+
+func (m *jetStreamMsg) Subject() string {
+	return m.msg.Subject
+}
+
+func (m *jetStreamMsg) Data() []byte {
+	return m.msg.Data
+}
+
+func (m *jetStreamMsg) ID() string {
+	metadata, err := m.msg.Metadata()
+	if err != nil {
+		return ""
+	}
+	return strconv.FormatUint(metadata.Sequence.Stream, 10)
+}
+
+func (m *jetStreamMsg) Redelivered() bool {
+	return m.RedeliveryCount() > 0
+}
+
+func (m *jetStreamMsg) RedeliveryCount() int {
+	metadata, err := m.msg.Metadata()
+	if err != nil || metadata.NumDelivered == 0 {
+		return 0
+	}
+	return int(metadata.NumDelivered) - 1
+}
+
+func (m *jetStreamMsg) Ack() error {
+	return m.msg.Ack()
+}
@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func runJetStreamServer(t *testing.T) *server.Server {
+
+	natsServer, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+	})
+	assert.NoError(t, err)
+
+	go natsServer.Start()
+	if !natsServer.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server did not start")
+	}
+	t.Cleanup(natsServer.Shutdown)
+	return natsServer
+}
+
+func TestJetStreamDurableSurvivesCloseAndUnsubscribe(t *testing.T) {
+
+	natsServer := runJetStreamServer(t)
+	t.Setenv("QUEUE_URL", natsServer.ClientURL())
+
+	queue, err := NewJetStreamQueue(logrus.NewEntry(logrus.New()))
+	assert.NoError(t, err)
+	defer queue.Close()
+
+	subscribe := func(messages chan Msg) Subscription {
+		subscription, err := queue.QueueSubscribe("route.message.send", "smpp-route", func(m Msg) {
+			messages <- m
+		}, DurableName("route_send_sub"), SetManualAckMode(), StartWithLastReceived())
+		assert.NoError(t, err)
+		return subscription
+	}
+
+	messages := make(chan Msg, 10)
+	subscription := subscribe(messages)
+	assert.NoError(t, queue.Publish("route.message.send", []byte("first")))
+	assert.NoError(t, receive(t, messages).Ack())
+	assert.NoError(t, subscription.Close())
+
+	// Queued while no replica is subscribed, it must still be delivered
+	assert.NoError(t, queue.Publish("route.message.send", []byte("second")))
+
+	_, err = queue.jetStream.ConsumerInfo("ROUTE", "route_send_sub")
+	assert.NoError(t, err)
+
+	messages = make(chan Msg, 10)
+	subscription = subscribe(messages)
+	m := receive(t, messages)
+	assert.Equal(t, "second", string(m.Data()))
+	assert.NoError(t, m.Ack())
+	assert.NoError(t, subscription.Unsubscribe())
+
+	_, err = queue.jetStream.ConsumerInfo("ROUTE", "route_send_sub")
+	assert.NoError(t, err)
+
+	assert.NoError(t, queue.Publish("route.message.send", []byte("third")))
+
+	messages = make(chan Msg, 10)
+	subscription = subscribe(messages)
+	defer subscription.Close()
+	assert.Equal(t, "third", string(receive(t, messages).Data()))
+}
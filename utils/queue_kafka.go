@@ -0,0 +1,561 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KafkaQueue keeps messages on Kafka. Every subject is a topic of the same
+// name and a queue group with a durable name consumes through the consumer
+// group "<queue group>.<durable name>" e.g. smpp-test_smsc.test_smsc_send_sub.
+// Offsets are only committed up to the oldest message not yet acknowledged so
+// unacknowledged messages are delivered again after a restart or rebalance.
+// Subscriptions that are neither shared nor durable read every partition of
+// the topic without a consumer group, so every replica sees every message and
+// starts from where it asked to on every start.
+type KafkaQueue struct {
+	brokers []string
+	writer  *kafka.Writer
+	log     *logrus.Entry
+
+	mu            sync.Mutex
+	subscriptions map[*kafkaSubscription]bool
+
+	healthMu  sync.Mutex
+	checking  bool
+	checkedAt time.Time
+	connected bool
+}
+
+// NewKafkaQueue connects to the brokers listed in QUEUE_URL e.g. kafka://broker1:9092,broker2:9092
+func NewKafkaQueue(log *logrus.Entry) (*KafkaQueue, error) {
+
+	queueURL := strings.TrimPrefix(GetEnv("QUEUE_URL", "kafka://localhost:9092"), "kafka://")
+
+	var brokers []string
+	for _, broker := range strings.Split(queueURL, ",") {
+		if broker = strings.TrimSpace(broker); broker != "" {
+			brokers = append(brokers, broker)
+		}
+	}
+	if len(brokers) == 0 {
+		return nil, errors.New("no kafka brokers were configured")
+	}
+
+	return &KafkaQueue{
+		brokers: brokers,
+		writer: &kafka.Writer{
+			Addr:                   kafka.TCP(brokers...),
+			Balancer:               &kafka.Hash{},
+			RequiredAcks:           kafka.RequireAll,
+			AllowAutoTopicCreation: true,
+			BatchTimeout:           10 * time.Millisecond,
+		},
+		log:           log,
+		subscriptions: make(map[*kafkaSubscription]bool),
+	}, nil
+}
+
+func (q *KafkaQueue) Publish(subject string, data []byte) error {
+	return q.writer.WriteMessages(context.Background(), kafka.Message{Topic: subject, Value: data})
+}
+
+func (q *KafkaQueue) Subscribe(subject string, handler MsgHandler, options ...SubscriptionOption) (Subscription, error) {
+	return q.QueueSubscribe(subject, "", handler, options...)
+}
+
+func (q *KafkaQueue) QueueSubscribe(subject string, group string, handler MsgHandler, options ...SubscriptionOption) (Subscription, error) {
+
+	subOptions := applySubscriptionOptions(options)
+	subscription := q.newSubscription(handler, subOptions)
+
+	if group == "" && subOptions.DurableName == "" {
+		readers, err := q.partitionReaders(subscription.ctx, subject, subOptions)
+		if err != nil {
+			subscription.cancel()
+			return nil, err
+		}
+		for _, reader := range readers {
+			subscription.readers = append(subscription.readers, reader)
+		}
+	} else {
+		subscription.readers = []kafkaReader{q.groupReader(subject, group, subOptions)}
+		subscription.grouped = true
+	}
+
+	q.start(subscription)
+	return subscription, nil
+}
+
+func (q *KafkaQueue) newSubscription(handler MsgHandler, subOptions SubscriptionOptions) *kafkaSubscription {
+
+	if subOptions.MaxInflight < 1 {
+		subOptions.MaxInflight = 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &kafkaSubscription{
+		queue:      q,
+		handler:    handler,
+		options:    subOptions,
+		ctx:        ctx,
+		cancel:     cancel,
+		inflight:   make(chan struct{}, subOptions.MaxInflight),
+		deliveries: make(chan *kafkaMsg, 2*subOptions.MaxInflight),
+		partitions: make(map[int][]*kafkaDelivery),
+	}
+}
+
+// start consumes through the subscription's readers
+func (q *KafkaQueue) start(subscription *kafkaSubscription) {
+
+	q.mu.Lock()
+	q.subscriptions[subscription] = true
+	q.mu.Unlock()
+
+	subscription.wg.Add(len(subscription.readers) + 2)
+	for _, reader := range subscription.readers {
+		go subscription.fetch(reader)
+	}
+	go subscription.handle()
+	go subscription.redeliverExpired()
+}
+
+// groupReader consumes through a consumer group that commits its offsets so
+// the group resumes from where it was acknowledged up to
+func (q *KafkaQueue) groupReader(subject string, group string, subOptions SubscriptionOptions) *kafka.Reader {
+
+	var groupID string
+	switch {
+	case group != "" && subOptions.DurableName != "":
+		groupID = fmt.Sprintf("%s.%s", group, subOptions.DurableName)
+	case group != "":
+		groupID = group
+	default:
+		groupID = subOptions.DurableName
+	}
+
+	return kafka.NewReader(kafka.ReaderConfig{
+		Brokers:     q.brokers,
+		GroupID:     groupID,
+		Topic:       subject,
+		StartOffset: groupStartOffset(subOptions),
+		MaxWait:     time.Second,
+	})
+}
+
+// groupStartOffset is where a consumer group without committed offsets starts,
+// a group after a time delta starts from the first offset and skips what is
+// older as it reads as a group can't be positioned by time
+func groupStartOffset(subOptions SubscriptionOptions) int64 {
+	if subOptions.StartAt == StartAllAvailable || subOptions.StartAt == StartTimeDelta {
+		return kafka.FirstOffset
+	}
+	return kafka.LastOffset
+}
+
+// partitionReaders reads every partition of the topic without a consumer group
+// positioned where the subscription asked to start from. Partitions added to the
+// topic later are picked up on resubscribing.
+func (q *KafkaQueue) partitionReaders(ctx context.Context, subject string, subOptions SubscriptionOptions) ([]*kafka.Reader, error) {
+
+	partitions, err := q.topicPartitions(ctx, subject)
+	if err != nil {
+		return nil, err
+	}
+
+	readers := make([]*kafka.Reader, 0, len(partitions))
+	closeReaders := func() {
+		for _, reader := range readers {
+			_ = reader.Close()
+		}
+	}
+
+	for _, partition := range partitions {
+		reader := kafka.NewReader(kafka.ReaderConfig{
+			Brokers:   q.brokers,
+			Topic:     subject,
+			Partition: partition.ID,
+			MaxWait:   time.Second,
+		})
+		readers = append(readers, reader)
+
+		partition := partition
+		err = positionReader(ctx, reader, subOptions, func() (int64, int64, error) {
+			return q.partitionOffsets(ctx, partition)
+		})
+		if err != nil {
+			closeReaders()
+			return nil, err
+		}
+	}
+
+	return readers, nil
+}
+
+// kafkaPositioner is the part of a partition reader that seeks
+type kafkaPositioner interface {
+	SetOffset(offset int64) error
+	SetOffsetAt(ctx context.Context, t time.Time) error
+}
+
+// positionReader seeks a partition reader to where the subscription starts,
+// offsets gives the first and last offsets of the partition
+func positionReader(ctx context.Context, reader kafkaPositioner, subOptions SubscriptionOptions,
+	offsets func() (int64, int64, error)) error {
+
+	switch subOptions.StartAt {
+	case StartAllAvailable:
+		return reader.SetOffset(kafka.FirstOffset)
+	case StartTimeDelta:
+		return reader.SetOffsetAt(ctx, time.Now().Add(-subOptions.StartTimeDelta))
+	case StartLastReceived:
+		first, last, err := offsets()
+		if err != nil {
+			return err
+		}
+		// The last offset is the one the next message gets, the last received is the one before it
+		if last > first {
+			last--
+		}
+		return reader.SetOffset(last)
+	default:
+		return reader.SetOffset(kafka.LastOffset)
+	}
+}
+
+// partitionOffsets reads the first and last offsets of a partition from its leader
+func (q *KafkaQueue) partitionOffsets(ctx context.Context, partition kafka.Partition) (int64, int64, error) {
+
+	conn, err := kafka.DialLeader(ctx, "tcp", fmt.Sprintf("%s:%d", partition.Leader.Host, partition.Leader.Port),
+		partition.Topic, partition.ID)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+
+	return conn.ReadOffsets()
+}
+
+// topicPartitions lists the partitions of a topic creating the topic with the
+// broker defaults if nothing was published to it yet
+func (q *KafkaQueue) topicPartitions(ctx context.Context, topic string) ([]kafka.Partition, error) {
+
+	conn, err := q.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	partitions, err := conn.ReadPartitions(topic)
+	if err == nil && len(partitions) > 0 {
+		return partitions, nil
+	}
+	if err != nil && !errors.Is(err, kafka.UnknownTopicOrPartition) {
+		return nil, err
+	}
+
+	controller, err := conn.Controller()
+	if err != nil {
+		return nil, err
+	}
+	controllerConn, err := kafka.DialContext(ctx, "tcp", fmt.Sprintf("%s:%d", controller.Host, controller.Port))
+	if err != nil {
+		return nil, err
+	}
+	defer controllerConn.Close()
+
+	err = controllerConn.CreateTopics(kafka.TopicConfig{Topic: topic, NumPartitions: -1, ReplicationFactor: -1})
+	if err != nil && !errors.Is(err, kafka.TopicAlreadyExists) {
+		return nil, err
+	}
+
+	return conn.ReadPartitions(topic)
+}
+
+// dial connects to the first broker that accepts a connection
+func (q *KafkaQueue) dial(ctx context.Context) (*kafka.Conn, error) {
+
+	var err error
+	for _, broker := range q.brokers {
+		var conn *kafka.Conn
+		conn, err = kafka.DialContext(ctx, "tcp", broker)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// IsConnected is true if one of the brokers accepted a connection recently,
+// the result is kept for a few seconds so health checks stay cheap. Callers
+// arriving while the brokers are probed get the last result instead of waiting.
+func (q *KafkaQueue) IsConnected() bool {
+	q.healthMu.Lock()
+	if q.checking || time.Since(q.checkedAt) < 5*time.Second {
+		connected := q.connected
+		q.healthMu.Unlock()
+		return connected
+	}
+	q.checking = true
+	q.healthMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	connected := false
+	conn, err := q.dial(ctx)
+	if err == nil {
+		_ = conn.Close()
+		connected = true
+	}
+
+	q.healthMu.Lock()
+	q.connected, q.checkedAt, q.checking = connected, time.Now(), false
+	q.healthMu.Unlock()
+	return connected
+}
+
+func (q *KafkaQueue) Close() error {
+
+	q.mu.Lock()
+	subscriptions := make([]*kafkaSubscription, 0, len(q.subscriptions))
+	for subscription := range q.subscriptions {
+		subscriptions = append(subscriptions, subscription)
+	}
+	q.mu.Unlock()
+
+	for _, subscription := range subscriptions {
+		err := subscription.Close()
+		if err != nil {
+			q.log.WithError(err).Warn("failed to close kafka subscription")
+		}
+	}
+
+	return q.writer.Close()
+}
+
+type kafkaDelivery struct {
+	message     kafka.Message
+	deliveredAt time.Time
+	count       int
+	acked       bool
+}
+
+// kafkaReader is the part of a kafka reader a subscription consumes through
+type kafkaReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, messages ...kafka.Message) error
+	Config() kafka.ReaderConfig
+	Close() error
+}
+
+type kafkaSubscription struct {
+	queue   *KafkaQueue
+	handler MsgHandler
+	options SubscriptionOptions
+	readers []kafkaReader
+	// grouped subscriptions have a single reader that commits its offsets
+	grouped bool
+
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+	closeOnce  sync.Once
+	inflight   chan struct{}
+	deliveries chan *kafkaMsg
+
+	mu         sync.Mutex
+	partitions map[int][]*kafkaDelivery
+}
+
+// fetch reads messages while there is room in flight for them
+func (s *kafkaSubscription) fetch(reader kafkaReader) {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case s.inflight <- struct{}{}:
+		case <-s.ctx.Done():
+			return
+		}
+
+		message, err := reader.FetchMessage(s.ctx)
+		if err != nil {
+			<-s.inflight
+			if s.ctx.Err() != nil {
+				return
+			}
+			s.queue.log.WithError(err).Warnf("could not fetch from kafka topic %s", reader.Config().Topic)
+			select {
+			case <-time.After(time.Second):
+			case <-s.ctx.Done():
+				return
+			}
+			continue
+		}
+
+		delivery := &kafkaDelivery{message: message, deliveredAt: time.Now()}
+
+		s.mu.Lock()
+		s.partitions[message.Partition] = append(s.partitions[message.Partition], delivery)
+		s.mu.Unlock()
+
+		// Messages from before the requested time delta are skipped but still
+		// committed so the group moves past them
+		if s.options.StartAt == StartTimeDelta && time.Since(message.Time) > s.options.StartTimeDelta {
+			s.ack(delivery)
+			continue
+		}
+
+		s.deliver(&kafkaMsg{subscription: s, delivery: delivery, count: 0})
+	}
+}
+
+func (s *kafkaSubscription) deliver(msg *kafkaMsg) {
+	select {
+	case s.deliveries <- msg:
+	case <-s.ctx.Done():
+	}
+}
+
+// handle calls the handler one message at a time like the streaming clients do
+func (s *kafkaSubscription) handle() {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case msg := <-s.deliveries:
+			s.handler(msg)
+			if !s.options.ManualAcks {
+				_ = msg.Ack()
+			}
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *kafkaSubscription) redeliverExpired() {
+	defer s.wg.Done()
+
+	interval := time.Second
+	if s.options.AckWait > 0 && s.options.AckWait < interval {
+		interval = s.options.AckWait
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			var due []*kafkaMsg
+
+			s.mu.Lock()
+			for _, deliveries := range s.partitions {
+				for _, delivery := range deliveries {
+					if !delivery.acked && time.Since(delivery.deliveredAt) > s.options.AckWait {
+						delivery.count++
+						delivery.deliveredAt = time.Now()
+						due = append(due, &kafkaMsg{subscription: s, delivery: delivery, count: delivery.count})
+					}
+				}
+			}
+			s.mu.Unlock()
+
+			for _, msg := range due {
+				s.deliver(msg)
+			}
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// ack marks the delivery done and commits the partition up to the oldest
+// message still waiting on an acknowledgement
+func (s *kafkaSubscription) ack(delivery *kafkaDelivery) error {
+
+	s.mu.Lock()
+	if delivery.acked {
+		s.mu.Unlock()
+		return nil
+	}
+	delivery.acked = true
+	<-s.inflight
+
+	partition := delivery.message.Partition
+	deliveries := s.partitions[partition]
+
+	var commit *kafka.Message
+	for len(deliveries) > 0 && deliveries[0].acked {
+		commit = &deliveries[0].message
+		deliveries = deliveries[1:]
+	}
+	s.partitions[partition] = deliveries
+	s.mu.Unlock()
+
+	if commit == nil || !s.grouped {
+		return nil
+	}
+	return s.readers[0].CommitMessages(s.ctx, *commit)
+}
+
+// Unsubscribe stops consuming, committed offsets stay with the consumer group
+func (s *kafkaSubscription) Unsubscribe() error {
+	return s.Close()
+}
+
+func (s *kafkaSubscription) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		s.cancel()
+		s.wg.Wait()
+		for _, reader := range s.readers {
+			if closeErr := reader.Close(); closeErr != nil {
+				err = closeErr
+			}
+		}
+
+		s.queue.mu.Lock()
+		delete(s.queue.subscriptions, s)
+		s.queue.mu.Unlock()
+	})
+	return err
+}
+
+type kafkaMsg struct {
+	subscription *kafkaSubscription
+	delivery     *kafkaDelivery
+	count        int
+}
+
+func (m *kafkaMsg) Subject() string {
+	return m.delivery.message.Topic
+}
+
+func (m *kafkaMsg) Data() []byte {
+	return m.delivery.message.Value
+}
+
+func (m *kafkaMsg) ID() string {
+	return fmt.Sprintf("%d-%d", m.delivery.message.Partition, m.delivery.message.Offset)
+}
+
+func (m *kafkaMsg) Redelivered() bool {
+	return m.count > 0
+}
+
+func (m *kafkaMsg) RedeliveryCount() int {
+	return m.count
+}
+
+func (m *kafkaMsg) Ack() error {
+	return m.subscription.ack(m.delivery)
+}
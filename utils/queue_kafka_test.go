@@ -0,0 +1,174 @@
+package utils
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeKafkaReader hands out the messages it was given and records commits
+type fakeKafkaReader struct {
+	messages chan kafka.Message
+
+	mu        sync.Mutex
+	committed []int64
+}
+
+func newFakeKafkaReader(messages ...kafka.Message) *fakeKafkaReader {
+	reader := &fakeKafkaReader{messages: make(chan kafka.Message, len(messages))}
+	for _, message := range messages {
+		reader.messages <- message
+	}
+	return reader
+}
+
+func (r *fakeKafkaReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	select {
+	case message := <-r.messages:
+		return message, nil
+	case <-ctx.Done():
+		return kafka.Message{}, ctx.Err()
+	}
+}
+
+func (r *fakeKafkaReader) CommitMessages(ctx context.Context, messages ...kafka.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, message := range messages {
+		r.committed = append(r.committed, message.Offset)
+	}
+	return nil
+}
+
+func (r *fakeKafkaReader) Commits() []int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]int64(nil), r.committed...)
+}
+
+func (r *fakeKafkaReader) Config() kafka.ReaderConfig {
+	return kafka.ReaderConfig{Topic: "route.message.send"}
+}
+func (r *fakeKafkaReader) Close() error { return nil }
+
+func kafkaMessage(offset int64, value string, at time.Time) kafka.Message {
+	return kafka.Message{Topic: "route.message.send", Partition: 0, Offset: offset, Value: []byte(value), Time: at}
+}
+
+func subscribeFake(t *testing.T, reader *fakeKafkaReader, handler MsgHandler, options ...SubscriptionOption) *kafkaSubscription {
+	queue := &KafkaQueue{log: logrus.NewEntry(logrus.New()), subscriptions: make(map[*kafkaSubscription]bool)}
+	subscription := queue.newSubscription(handler, applySubscriptionOptions(options))
+	subscription.readers = []kafkaReader{reader}
+	subscription.grouped = true
+	queue.start(subscription)
+	t.Cleanup(func() { _ = subscription.Close() })
+	return subscription
+}
+
+func TestKafkaCommitsUpToTheOldestUnacknowledged(t *testing.T) {
+
+	now := time.Now()
+	reader := newFakeKafkaReader(kafkaMessage(0, "a", now), kafkaMessage(1, "b", now), kafkaMessage(2, "c", now))
+
+	messages := make(chan Msg, 10)
+	subscribeFake(t, reader, func(m Msg) { messages <- m }, SetManualAckMode(), MaxInflight(10), AckWait(time.Minute))
+
+	first, second, third := receive(t, messages), receive(t, messages), receive(t, messages)
+
+	assert.NoError(t, second.Ack())
+	assert.Empty(t, reader.Commits(), "nothing is committed past an unacknowledged message")
+
+	assert.NoError(t, first.Ack())
+	assert.Equal(t, []int64{1}, reader.Commits())
+
+	assert.NoError(t, third.Ack())
+	assert.NoError(t, third.Ack())
+	assert.Equal(t, []int64{1, 2}, reader.Commits())
+}
+
+func TestKafkaRedeliversUnacknowledged(t *testing.T) {
+
+	reader := newFakeKafkaReader(kafkaMessage(0, "otp", time.Now()))
+
+	messages := make(chan Msg, 10)
+	subscribeFake(t, reader, func(m Msg) { messages <- m }, SetManualAckMode(), AckWait(100*time.Millisecond))
+
+	first := receive(t, messages)
+	assert.False(t, first.Redelivered())
+
+	second := receive(t, messages)
+	assert.Equal(t, "otp", string(second.Data()))
+	assert.Equal(t, 1, second.RedeliveryCount())
+	assert.Equal(t, first.ID(), second.ID())
+	assert.NoError(t, second.Ack())
+
+	select {
+	case m := <-messages:
+		t.Fatalf("acknowledged message was delivered again : %s", m.Data())
+	case <-time.After(300 * time.Millisecond):
+	}
+	assert.Equal(t, []int64{0}, reader.Commits())
+}
+
+func TestKafkaGroupSkipsMessagesBeforeTheTimeDelta(t *testing.T) {
+
+	assert.Equal(t, kafka.FirstOffset, groupStartOffset(applySubscriptionOptions([]SubscriptionOption{StartAtTimeDelta(time.Hour)})))
+	assert.Equal(t, kafka.LastOffset, groupStartOffset(applySubscriptionOptions(nil)))
+
+	reader := newFakeKafkaReader(kafkaMessage(0, "old", time.Now().Add(-2*time.Hour)), kafkaMessage(1, "new", time.Now()))
+
+	messages := make(chan Msg, 10)
+	subscribeFake(t, reader, func(m Msg) { messages <- m }, StartAtTimeDelta(time.Hour))
+
+	assert.Equal(t, "new", string(receive(t, messages).Data()))
+	assert.Eventually(t, func() bool {
+		commits := reader.Commits()
+		return len(commits) == 2 && commits[0] == 0 && commits[1] == 1
+	}, time.Second, 10*time.Millisecond, "skipped messages are committed so the group moves past them")
+}
+
+type fakePositioner struct {
+	offset int64
+	at     time.Time
+}
+
+func (p *fakePositioner) SetOffset(offset int64) error { p.offset = offset; return nil }
+func (p *fakePositioner) SetOffsetAt(ctx context.Context, t time.Time) error {
+	p.at = t
+	return nil
+}
+
+func TestKafkaPositionsPartitionReaders(t *testing.T) {
+
+	offsets := func(first, last int64) func() (int64, int64, error) {
+		return func() (int64, int64, error) { return first, last, nil }
+	}
+
+	for name, test := range map[string]struct {
+		option SubscriptionOption
+		first  int64
+		last   int64
+		offset int64
+	}{
+		"all available":         {DeliverAllAvailable(), 0, 10, kafka.FirstOffset},
+		"last received":         {StartWithLastReceived(), 3, 10, 9},
+		"last received of none": {StartWithLastReceived(), 4, 4, 4},
+		"new only":              {func(o *SubscriptionOptions) {}, 0, 10, kafka.LastOffset},
+	} {
+		reader := &fakePositioner{offset: -100}
+		err := positionReader(context.Background(), reader, applySubscriptionOptions([]SubscriptionOption{test.option}),
+			offsets(test.first, test.last))
+		assert.NoError(t, err, name)
+		assert.Equal(t, test.offset, reader.offset, name)
+	}
+
+	reader := &fakePositioner{}
+	assert.NoError(t, positionReader(context.Background(), reader,
+		applySubscriptionOptions([]SubscriptionOption{StartAtTimeDelta(time.Hour)}), offsets(0, 0)))
+	assert.WithinDuration(t, time.Now().Add(-time.Hour), reader.at, time.Second)
+}
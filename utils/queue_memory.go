@@ -0,0 +1,423 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrQueueClosed is returned when using a queue after it was closed
+var ErrQueueClosed = errors.New("queue is closed")
+
+// MemoryQueue is an in process queue for local development and tests. It
+// keeps every published message for the life of the process and honours
+// durable names, queue groups, start positions, manual acks, ack waits and
+// max in flight the same way the streaming backends do.
+type MemoryQueue struct {
+	mu        sync.Mutex
+	subjects  map[string][]*memoryMessage
+	consumers map[string]*memoryConsumer
+	sequence  uint64
+	closed    bool
+	exit      chan struct{}
+}
+
+type memoryMessage struct {
+	sequence  uint64
+	subject   string
+	data      []byte
+	timestamp time.Time
+}
+
+// memoryConsumer is the shared state of the members of a subscription, it
+// tracks the next message to deliver and the ones waiting on an ack
+type memoryConsumer struct {
+	key       string
+	subject   string
+	durable   bool
+	options   SubscriptionOptions
+	next      int
+	pending   map[uint64]*memoryDelivery
+	redeliver []*memoryDelivery
+	members   []*memorySubscription
+	turn      int
+}
+
+type memoryDelivery struct {
+	message     *memoryMessage
+	member      *memorySubscription
+	deliveredAt time.Time
+	count       int
+	acked       bool
+}
+
+type memorySubscription struct {
+	queue    *MemoryQueue
+	consumer *memoryConsumer
+	handler  MsgHandler
+	inflight int
+	buffer   []*memoryMsg
+	notify   chan struct{}
+	closed   bool
+}
+
+// NewMemoryQueue creates an empty in process queue
+func NewMemoryQueue() *MemoryQueue {
+	q := &MemoryQueue{
+		subjects:  make(map[string][]*memoryMessage),
+		consumers: make(map[string]*memoryConsumer),
+		exit:      make(chan struct{}),
+	}
+
+	go q.redeliverExpired()
+	return q
+}
+
+func (q *MemoryQueue) Publish(subject string, data []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrQueueClosed
+	}
+
+	q.sequence++
+	q.subjects[subject] = append(q.subjects[subject], &memoryMessage{
+		sequence:  q.sequence,
+		subject:   subject,
+		data:      append([]byte(nil), data...),
+		timestamp: time.Now(),
+	})
+
+	for _, consumer := range q.consumers {
+		if consumer.subject == subject {
+			q.dispatch(consumer)
+		}
+	}
+	return nil
+}
+
+func (q *MemoryQueue) Subscribe(subject string, handler MsgHandler, options ...SubscriptionOption) (Subscription, error) {
+	return q.QueueSubscribe(subject, "", handler, options...)
+}
+
+func (q *MemoryQueue) QueueSubscribe(subject string, group string, handler MsgHandler, options ...SubscriptionOption) (Subscription, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil, ErrQueueClosed
+	}
+
+	subOptions := applySubscriptionOptions(options)
+	if subOptions.MaxInflight < 1 {
+		subOptions.MaxInflight = 1
+	}
+
+	q.sequence++
+	key := fmt.Sprintf("%s|%s|%s", subject, group, subOptions.DurableName)
+	if group == "" && subOptions.DurableName == "" {
+		key = fmt.Sprintf("%s|%d", key, q.sequence)
+	}
+
+	consumer, ok := q.consumers[key]
+	if !ok {
+		consumer = &memoryConsumer{
+			key:     key,
+			subject: subject,
+			durable: subOptions.DurableName != "",
+			options: subOptions,
+			next:    q.startIndex(subject, subOptions),
+			pending: make(map[uint64]*memoryDelivery),
+		}
+		q.consumers[key] = consumer
+	}
+
+	member := &memorySubscription{
+		queue:    q,
+		consumer: consumer,
+		handler:  handler,
+		notify:   make(chan struct{}, 1),
+	}
+	consumer.members = append(consumer.members, member)
+
+	go member.run()
+	q.dispatch(consumer)
+
+	return member, nil
+}
+
+func (q *MemoryQueue) startIndex(subject string, options SubscriptionOptions) int {
+	messages := q.subjects[subject]
+
+	switch options.StartAt {
+	case StartAllAvailable:
+		return 0
+	case StartLastReceived:
+		if len(messages) > 0 {
+			return len(messages) - 1
+		}
+	case StartTimeDelta:
+		since := time.Now().Add(-options.StartTimeDelta)
+		for i, message := range messages {
+			if !message.timestamp.Before(since) {
+				return i
+			}
+		}
+	}
+	return len(messages)
+}
+
+// dispatch hands due redeliveries then new messages to members with capacity,
+// it must be called with the queue lock held
+func (q *MemoryQueue) dispatch(consumer *memoryConsumer) {
+
+	for {
+		member := consumer.nextMember()
+		if member == nil {
+			return
+		}
+
+		var delivery *memoryDelivery
+		if len(consumer.redeliver) > 0 {
+			delivery = consumer.redeliver[0]
+			consumer.redeliver = consumer.redeliver[1:]
+			delivery.count++
+		} else {
+			messages := q.subjects[consumer.subject]
+			if consumer.next >= len(messages) {
+				return
+			}
+			delivery = &memoryDelivery{message: messages[consumer.next]}
+			consumer.next++
+			consumer.pending[delivery.message.sequence] = delivery
+		}
+
+		delivery.member = member
+		delivery.deliveredAt = time.Now()
+		member.inflight++
+		member.push(&memoryMsg{
+			queue:    q,
+			consumer: consumer,
+			delivery: delivery,
+			count:    delivery.count,
+		})
+	}
+}
+
+// nextMember picks the member to deliver to in turn skipping those at capacity
+func (c *memoryConsumer) nextMember() *memorySubscription {
+	for i := 0; i < len(c.members); i++ {
+		c.turn = (c.turn + 1) % len(c.members)
+		member := c.members[c.turn]
+		if !member.closed && member.inflight < c.options.MaxInflight {
+			return member
+		}
+	}
+	return nil
+}
+
+func (q *MemoryQueue) ack(consumer *memoryConsumer, delivery *memoryDelivery) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if delivery.acked {
+		return
+	}
+
+	// A late ack after the message was handed to another member still counts
+	current, ok := consumer.pending[delivery.message.sequence]
+	if !ok {
+		return
+	}
+
+	current.acked = true
+	delete(consumer.pending, delivery.message.sequence)
+	if current.member != nil {
+		current.member.inflight--
+	}
+
+	for i, waiting := range consumer.redeliver {
+		if waiting == current {
+			consumer.redeliver = append(consumer.redeliver[:i], consumer.redeliver[i+1:]...)
+			break
+		}
+	}
+
+	q.dispatch(consumer)
+}
+
+func (q *MemoryQueue) redeliverExpired() {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			q.mu.Lock()
+			for _, consumer := range q.consumers {
+				for _, delivery := range consumer.pending {
+					if delivery.member != nil && time.Since(delivery.deliveredAt) > consumer.options.AckWait {
+						consumer.release(delivery)
+					}
+				}
+				q.dispatch(consumer)
+			}
+			q.mu.Unlock()
+		case <-q.exit:
+			return
+		}
+	}
+}
+
+// release takes a delivery back from its member so it can be redelivered
+func (c *memoryConsumer) release(delivery *memoryDelivery) {
+	delivery.member.inflight--
+	delivery.member = nil
+	c.redeliver = append(c.redeliver, delivery)
+}
+
+// IsConnected is true until the queue is closed
+func (q *MemoryQueue) IsConnected() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return !q.closed
+}
+
+func (q *MemoryQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	close(q.exit)
+
+	for _, consumer := range q.consumers {
+		for _, member := range consumer.members {
+			member.stop()
+		}
+		consumer.members = nil
+	}
+	q.consumers = make(map[string]*memoryConsumer)
+	return nil
+}
+
+// push buffers a message for the member, it must be called with the queue lock held
+func (s *memorySubscription) push(msg *memoryMsg) {
+	s.buffer = append(s.buffer, msg)
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// run hands buffered messages to the handler one at a time like the
+// streaming clients do
+func (s *memorySubscription) run() {
+	for {
+		s.queue.mu.Lock()
+		if s.closed {
+			s.queue.mu.Unlock()
+			return
+		}
+		if len(s.buffer) == 0 {
+			s.queue.mu.Unlock()
+			<-s.notify
+			continue
+		}
+		msg := s.buffer[0]
+		s.buffer = s.buffer[1:]
+		s.queue.mu.Unlock()
+
+		s.handler(msg)
+
+		if !s.consumer.options.ManualAcks {
+			_ = msg.Ack()
+		}
+	}
+}
+
+// stop must be called with the queue lock held
+func (s *memorySubscription) stop() {
+	if !s.closed {
+		s.closed = true
+		s.buffer = nil
+		close(s.notify)
+	}
+}
+
+func (s *memorySubscription) leave(unsubscribe bool) error {
+	s.queue.mu.Lock()
+	defer s.queue.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.stop()
+
+	consumer := s.consumer
+	for i, member := range consumer.members {
+		if member == s {
+			consumer.members = append(consumer.members[:i], consumer.members[i+1:]...)
+			break
+		}
+	}
+
+	for _, delivery := range consumer.pending {
+		if delivery.member == s {
+			consumer.release(delivery)
+		}
+	}
+
+	if len(consumer.members) == 0 && (unsubscribe || !consumer.durable) {
+		delete(s.queue.consumers, consumer.key)
+		return nil
+	}
+
+	s.queue.dispatch(consumer)
+	return nil
+}
+
+func (s *memorySubscription) Unsubscribe() error {
+	return s.leave(true)
+}
+
+func (s *memorySubscription) Close() error {
+	return s.leave(false)
+}
+
+type memoryMsg struct {
+	queue    *MemoryQueue
+	consumer *memoryConsumer
+	delivery *memoryDelivery
+	count    int
+}
+
+func (m *memoryMsg) Subject() string {
+	return m.delivery.message.subject
+}
+
+func (m *memoryMsg) Data() []byte {
+	return m.delivery.message.data
+}
+
+func (m *memoryMsg) ID() string {
+	return strconv.FormatUint(m.delivery.message.sequence, 10)
+}
+
+func (m *memoryMsg) Redelivered() bool {
+	return m.count > 0
+}
+
+func (m *memoryMsg) RedeliveryCount() int {
+	return m.count
+}
+
+func (m *memoryMsg) Ack() error {
+	m.queue.ack(m.consumer, m.delivery)
+	return nil
+}
@@ -0,0 +1,116 @@
+package utils
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func receive(t *testing.T, messages <-chan Msg) Msg {
+	select {
+	case m := <-messages:
+		return m
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a message")
+		return nil
+	}
+}
+
+func TestMemoryQueueRedeliversUnacknowledged(t *testing.T) {
+
+	queue := NewMemoryQueue()
+	defer queue.Close()
+
+	messages := make(chan Msg, 10)
+	_, err := queue.QueueSubscribe("route.message.send", "smpp-route", func(m Msg) {
+		messages <- m
+	}, DurableName("route_send_sub"), SetManualAckMode(), AckWait(100*time.Millisecond))
+	assert.NoError(t, err)
+
+	assert.NoError(t, queue.Publish("route.message.send", []byte("otp")))
+
+	first := receive(t, messages)
+	assert.Equal(t, "otp", string(first.Data()))
+	assert.False(t, first.Redelivered())
+
+	second := receive(t, messages)
+	assert.Equal(t, "otp", string(second.Data()))
+	assert.True(t, second.Redelivered())
+	assert.Equal(t, 1, second.RedeliveryCount())
+	assert.NoError(t, second.Ack())
+
+	select {
+	case m := <-messages:
+		t.Fatalf("acknowledged message was delivered again : %s", m.Data())
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestMemoryQueueDurableResumes(t *testing.T) {
+
+	queue := NewMemoryQueue()
+	defer queue.Close()
+
+	messages := make(chan Msg, 10)
+	handler := func(m Msg) {
+		messages <- m
+		_ = m.Ack()
+	}
+
+	subscription, err := queue.QueueSubscribe("route.message.dlr", "smpp-route", handler,
+		DurableName("route_receive_dlr"), SetManualAckMode())
+	assert.NoError(t, err)
+
+	assert.NoError(t, queue.Publish("route.message.dlr", []byte("1")))
+	assert.Equal(t, "1", string(receive(t, messages).Data()))
+
+	assert.NoError(t, subscription.Close())
+	assert.NoError(t, queue.Publish("route.message.dlr", []byte("2")))
+
+	_, err = queue.QueueSubscribe("route.message.dlr", "smpp-route", handler,
+		DurableName("route_receive_dlr"), SetManualAckMode())
+	assert.NoError(t, err)
+	assert.Equal(t, "2", string(receive(t, messages).Data()), "durable should resume after the last acknowledged message")
+}
+
+func TestMemoryQueueMaxInflight(t *testing.T) {
+
+	queue := NewMemoryQueue()
+	defer queue.Close()
+
+	var mu sync.Mutex
+	var unacknowledged []Msg
+	delivered := make(chan struct{}, 10)
+
+	_, err := queue.Subscribe("route.message.ack", func(m Msg) {
+		mu.Lock()
+		unacknowledged = append(unacknowledged, m)
+		mu.Unlock()
+		delivered <- struct{}{}
+	}, SetManualAckMode(), MaxInflight(2), AckWait(time.Minute), DeliverAllAvailable())
+	assert.NoError(t, err)
+
+	for _, data := range []string{"1", "2", "3"} {
+		assert.NoError(t, queue.Publish("route.message.ack", []byte(data)))
+	}
+
+	<-delivered
+	<-delivered
+	select {
+	case <-delivered:
+		t.Fatal("more messages were delivered than allowed in flight")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	mu.Lock()
+	assert.NoError(t, unacknowledged[0].Ack())
+	mu.Unlock()
+
+	select {
+	case <-delivered:
+	case <-time.After(2 * time.Second):
+		t.Fatal("acknowledging did not free up capacity")
+	}
+}
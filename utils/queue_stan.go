@@ -0,0 +1,315 @@
+package utils
+
+import (
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/stan.go"
+	"github.com/sirupsen/logrus"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// stanPingInterval is how often in seconds the streaming server is pinged and
+// stanPingMaxOut how many pings can go unanswered before the connection is lost
+var stanPingInterval, stanPingMaxOut = 10, 5
+
+func connectNats(log *logrus.Entry, options ...nats.Option) (*nats.Conn, error) {
+
+	queueURL := GetEnv("QUEUE_URL", nats.DefaultURL)
+
+	options = append([]nats.Option{
+		nats.ReconnectBufSize(50 * 1024 * 1024), nats.ReconnectWait(1 * time.Second), nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
+			log.Infof("queue got disconnected! Reason: %q", err)
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			log.Infof("queue got reconnected to %v!\n", nc.ConnectedUrl())
+		}),
+		nats.ClosedHandler(func(nc *nats.Conn) {
+			log.Infof("queue connection closed. Reason: %q\n", nc.LastError())
+		})}, options...)
+
+	// Connect to a server
+	return nats.Connect(queueURL, options...)
+}
+
+// StanQueue implements the "ICheckable" interface,
+// this is our gateway to health checking. When the streaming connection is
+// lost it keeps reconnecting and resubscribes every open subscription.
+type StanQueue struct {
+	natsConnection *nats.Conn
+	log            *logrus.Entry
+
+	mu            sync.RWMutex
+	connection    stan.Conn
+	disconnected  bool
+	reconnecting  bool
+	closed        bool
+	subscriptions map[*stanSubscription]bool
+}
+
+func (q *StanQueue) ConnectionLostListener(conn stan.Conn, reason error) {
+	q.log.Errorf("Connection lost, reason: %v", reason)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.disconnected = true
+	if q.closed || q.reconnecting {
+		return
+	}
+	q.reconnecting = true
+	go q.reconnect()
+}
+
+// NewStanQueue connects to the NATS streaming cluster
+func NewStanQueue(log *logrus.Entry) (*StanQueue, error) {
+
+	nc, err := connectNats(log)
+	if err != nil {
+		return nil, err
+	}
+
+	stanQueue, err := NewQue(log, nc)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	return stanQueue, nil
+}
+
+func NewQue(log *logrus.Entry, conn *nats.Conn) (*StanQueue, error) {
+
+	stanQueue := StanQueue{
+		natsConnection: conn,
+		log:            log,
+		disconnected:   false,
+		subscriptions:  make(map[*stanSubscription]bool),
+	}
+
+	stanConnection, err := stanQueue.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	stanQueue.connection = stanConnection
+	return &stanQueue, nil
+}
+
+func (q *StanQueue) connect() (stan.Conn, error) {
+
+	clusterID := GetEnv("QUEUE_CLUSTER_ID", "smpp_cluster")
+	clientID := GetEnv("QUEUE_CLIENT_ID", "smpp_router")
+
+	return stan.Connect(clusterID, clientID, stan.NatsConn(q.natsConnection),
+		stan.Pings(stanPingInterval, stanPingMaxOut),
+		stan.SetConnectionLostHandler(q.ConnectionLostListener))
+}
+
+// reconnect retries the streaming connection with a growing delay until it
+// succeeds or the queue is closed, then resubscribes the open subscriptions
+func (q *StanQueue) reconnect() {
+
+	delay := time.Second
+	for {
+		q.mu.RLock()
+		closed := q.closed
+		q.mu.RUnlock()
+		if closed {
+			return
+		}
+
+		connection, err := q.connect()
+		if err == nil {
+			q.mu.Lock()
+			if q.closed {
+				q.mu.Unlock()
+				_ = connection.Close()
+				return
+			}
+			q.connection = connection
+			q.disconnected = false
+			q.reconnecting = false
+			subscriptions := make([]*stanSubscription, 0, len(q.subscriptions))
+			for subscription := range q.subscriptions {
+				subscriptions = append(subscriptions, subscription)
+			}
+			q.mu.Unlock()
+
+			q.log.Infof("queue streaming connection re-established, resubscribing %d subscriptions", len(subscriptions))
+			for _, subscription := range subscriptions {
+				err = subscription.resubscribe(connection)
+				if err != nil {
+					q.log.WithError(err).Errorf("could not resubscribe to %s", subscription.subject)
+				}
+			}
+			return
+		}
+
+		q.log.WithError(err).Warnf("could not re-establish queue streaming connection, retrying in %v", delay)
+		time.Sleep(delay)
+		if delay < 30*time.Second {
+			delay *= 2
+		}
+	}
+}
+
+// IsConnected is true while both the nats and streaming connections are up
+func (q *StanQueue) IsConnected() bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	return !q.closed && !q.disconnected && q.natsConnection.IsConnected()
+}
+
+func (q *StanQueue) conn() stan.Conn {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.connection
+}
+
+func (q *StanQueue) Publish(subject string, data []byte) error {
+	return q.conn().Publish(subject, data)
+}
+
+func (q *StanQueue) Subscribe(subject string, handler MsgHandler, options ...SubscriptionOption) (Subscription, error) {
+	return q.QueueSubscribe(subject, "", handler, options...)
+}
+
+func (q *StanQueue) QueueSubscribe(subject string, group string, handler MsgHandler, options ...SubscriptionOption) (Subscription, error) {
+
+	subOptions := applySubscriptionOptions(options)
+
+	stanOptions := []stan.SubscriptionOption{
+		stan.AckWait(subOptions.AckWait),
+		stan.MaxInflight(subOptions.MaxInflight),
+	}
+
+	if subOptions.DurableName != "" {
+		stanOptions = append(stanOptions, stan.DurableName(subOptions.DurableName))
+	}
+
+	if subOptions.ManualAcks {
+		stanOptions = append(stanOptions, stan.SetManualAckMode())
+	}
+
+	switch subOptions.StartAt {
+	case StartLastReceived:
+		stanOptions = append(stanOptions, stan.StartWithLastReceived())
+	case StartAllAvailable:
+		stanOptions = append(stanOptions, stan.DeliverAllAvailable())
+	case StartTimeDelta:
+		stanOptions = append(stanOptions, stan.StartAtTimeDelta(subOptions.StartTimeDelta))
+	}
+
+	subscription := &stanSubscription{
+		queue:   q,
+		subject: subject,
+		group:   group,
+		options: stanOptions,
+		callback: func(m *stan.Msg) {
+			handler(&stanMsg{m})
+		},
+	}
+
+	err := subscription.resubscribe(q.conn())
+	if err != nil {
+		return nil, err
+	}
+
+	q.mu.Lock()
+	q.subscriptions[subscription] = true
+	q.mu.Unlock()
+
+	return subscription, nil
+}
+
+func (q *StanQueue) Close() error {
+	q.mu.Lock()
+	q.closed = true
+	connection := q.connection
+	q.mu.Unlock()
+
+	err := connection.Close()
+	q.natsConnection.Close()
+	return err
+}
+
+// stanSubscription remembers how it was made so that it can be made again on
+// a new streaming connection
+type stanSubscription struct {
+	queue    *StanQueue
+	subject  string
+	group    string
+	options  []stan.SubscriptionOption
+	callback stan.MsgHandler
+
+	mu           sync.Mutex
+	subscription stan.Subscription
+}
+
+func (s *stanSubscription) resubscribe(connection stan.Conn) error {
+
+	var subscription stan.Subscription
+	var err error
+	if s.group == "" {
+		subscription, err = connection.Subscribe(s.subject, s.callback, s.options...)
+	} else {
+		subscription, err = connection.QueueSubscribe(s.subject, s.group, s.callback, s.options...)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.subscription = subscription
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *stanSubscription) forget() stan.Subscription {
+	s.queue.mu.Lock()
+	delete(s.queue.subscriptions, s)
+	s.queue.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.subscription
+}
+
+func (s *stanSubscription) Unsubscribe() error {
+	return s.forget().Unsubscribe()
+}
+
+func (s *stanSubscription) Close() error {
+	return s.forget().Close()
+}
+
+type stanMsg struct {
+	msg *stan.Msg
+}
+
+func (m *stanMsg) Subject() string {
+	return m.msg.Subject
+}
+
+func (m *stanMsg) Data() []byte {
+	return m.msg.Data
+}
+
+func (m *stanMsg) ID() string {
+	return strconv.FormatUint(m.msg.Sequence, 10)
+}
+
+func (m *stanMsg) Redelivered() bool {
+	return m.msg.Redelivered
+}
+
+func (m *stanMsg) RedeliveryCount() int {
+	return int(m.msg.RedeliveryCount)
+}
+
+func (m *stanMsg) Ack() error {
+	return m.msg.Ack()
+}
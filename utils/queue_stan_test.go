@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	stand "github.com/nats-io/nats-streaming-server/server"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func runStreamingServer(t *testing.T, port int) *stand.StanServer {
+
+	natsOptions := stand.NewNATSOptions()
+	natsOptions.Host = "127.0.0.1"
+	natsOptions.Port = port
+	// The streaming server expects its instance check to time out rather than find no responders
+	natsOptions.NoHeaderSupport = true
+
+	options := stand.GetDefaultOptions()
+	options.ID = "smpp_cluster"
+
+	streamingServer, err := stand.RunServerWithOpts(options, natsOptions)
+	if err != nil {
+		t.Fatalf("streaming server did not start : %v", err)
+	}
+	return streamingServer
+}
+
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestStanQueueResubscribesAfterReconnecting(t *testing.T) {
+
+	interval, maxOut := stanPingInterval, stanPingMaxOut
+	stanPingInterval, stanPingMaxOut = 1, 2
+	defer func() { stanPingInterval, stanPingMaxOut = interval, maxOut }()
+
+	port := freePort(t)
+	streamingServer := runStreamingServer(t, port)
+	t.Setenv("QUEUE_URL", fmt.Sprintf("nats://127.0.0.1:%d", port))
+
+	queue, err := NewStanQueue(logrus.NewEntry(logrus.New()))
+	assert.NoError(t, err)
+	defer queue.Close()
+
+	messages := make(chan Msg, 10)
+	_, err = queue.QueueSubscribe("route.message.send", "smpp-route", func(m Msg) {
+		messages <- m
+	}, DurableName("route_send_sub"))
+	assert.NoError(t, err)
+
+	assert.True(t, queue.IsConnected())
+	assert.NoError(t, queue.Publish("route.message.send", []byte("before")))
+	assert.Equal(t, "before", string(receive(t, messages).Data()))
+
+	streamingServer.Shutdown()
+	assert.Eventually(t, func() bool { return !queue.IsConnected() }, 5*time.Second, 50*time.Millisecond,
+		"the queue still reports healthy with the server gone")
+
+	// A fresh server knows nothing of the old session so the queue has to
+	// connect again and redo its subscriptions before anything is delivered
+	streamingServer = runStreamingServer(t, port)
+	defer streamingServer.Shutdown()
+
+	assert.Eventually(t, func() bool { return queue.IsConnected() }, 15*time.Second, 100*time.Millisecond,
+		"the queue never reported healthy again")
+
+	assert.Eventually(t, func() bool {
+		if queue.Publish("route.message.send", []byte("after")) != nil {
+			return false
+		}
+		select {
+		case m := <-messages:
+			return string(m.Data()) == "after"
+		case <-time.After(200 * time.Millisecond):
+			return false
+		}
+	}, 15*time.Second, 100*time.Millisecond, "the subscription was not re-established")
+}
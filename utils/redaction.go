@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Redaction decides what personal data is masked before it is logged
+type Redaction struct {
+	// MSISDN masks all but the last digits of phone numbers
+	MSISDN bool
+	// Text replaces message bodies with their length
+	Text bool
+}
+
+// redaction is configured from LOG_REDACT_MSISDN and LOG_REDACT_TEXT by ConfigureLogging
+var redaction = Redaction{MSISDN: true, Text: true}
+
+// msisdnVisibleDigits are left unmasked so numbers can still be told apart
+const msisdnVisibleDigits = 3
+
+// minimumMSISDNDigits keeps shortcodes and alphanumeric senders readable
+const minimumMSISDNDigits = 7
+
+// redactedPayloadFields are the json fields of queued events holding personal data
+var redactedPayloadFields = map[string]func(string) string{
+	"from":       RedactMSISDN,
+	"to":         RedactMSISDN,
+	"msisdn":     RedactMSISDN,
+	"data":       RedactText,
+	"text":       RedactText,
+	"smsc_extra": RedactText,
+}
+
+// SetRedaction changes what is masked in logs
+func SetRedaction(r Redaction) {
+	redaction = r
+}
+
+// RedactMSISDN masks the digits of a phone number except the last few
+func RedactMSISDN(msisdn string) string {
+	if !redaction.MSISDN {
+		return msisdn
+	}
+
+	digits := 0
+	for _, c := range msisdn {
+		if unicode.IsDigit(c) {
+			digits++
+		}
+	}
+	if digits < minimumMSISDNDigits {
+		return msisdn
+	}
+
+	var masked strings.Builder
+	seen := 0
+	for _, c := range msisdn {
+		if unicode.IsDigit(c) {
+			seen++
+			if seen <= digits-msisdnVisibleDigits {
+				masked.WriteRune('*')
+				continue
+			}
+		}
+		masked.WriteRune(c)
+	}
+	return masked.String()
+}
+
+// RedactText replaces a message body with its length
+func RedactText(text string) string {
+	if !redaction.Text || text == "" {
+		return text
+	}
+	return fmt.Sprintf("[redacted %d chars]", len([]rune(text)))
+}
+
+// RedactSecret hides credentials entirely
+func RedactSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "*****"
+}
+
+// RedactPayload renders a queued json event for logging with its personal data masked
+func RedactPayload(data []byte) string {
+
+	var fields map[string]interface{}
+	if json.Unmarshal(data, &fields) != nil {
+		if redaction.Text {
+			return fmt.Sprintf("[redacted %d bytes]", len(data))
+		}
+		return string(data)
+	}
+
+	for key, value := range fields {
+		redact, ok := redactedPayloadFields[key]
+		if !ok {
+			continue
+		}
+		if text, ok := value.(string); ok {
+			fields[key] = redact(text)
+		}
+	}
+
+	redacted, err := json.Marshal(fields)
+	if err != nil {
+		return fmt.Sprintf("[redacted %d bytes]", len(data))
+	}
+	return string(redacted)
+}
@@ -0,0 +1,26 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedaction(t *testing.T) {
+
+	SetRedaction(Redaction{MSISDN: true, Text: true})
+	defer SetRedaction(Redaction{MSISDN: true, Text: true})
+
+	assert.Equal(t, "+*********100", RedactMSISDN("+254723549100"))
+	assert.Equal(t, "22333", RedactMSISDN("22333"), "shortcodes are not personal data")
+	assert.Equal(t, "ACME", RedactMSISDN("ACME"))
+	assert.Equal(t, "[redacted 11 chars]", RedactText("Your OTP 42"))
+
+	assert.JSONEq(t, `{"message_id":"m1","from":"ACME","to":"*********100","data":"[redacted 5 chars]"}`,
+		RedactPayload([]byte(`{"message_id":"m1","from":"ACME","to":"254723549100","data":"hello"}`)))
+	assert.Equal(t, "[redacted 8 bytes]", RedactPayload([]byte("not json")))
+
+	SetRedaction(Redaction{})
+	assert.Equal(t, "254723549100", RedactMSISDN("254723549100"))
+	assert.Equal(t, "hello", RedactText("hello"))
+}
@@ -1,38 +1,138 @@
 package utils
 
 import (
+	"context"
+	"fmt"
 	gcpExporter "github.com/GoogleCloudPlatform/opentelemetry-operations-go/exporter/trace"
 	"github.com/sirupsen/logrus"
-	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
 )
 
-// ConfigureTracer Configures an implementation for tracing purposes
-func ConfigureTracer(serviceName string, log *logrus.Entry) error {
+const (
+	// TraceExporterGCP sends spans to Google Cloud Trace for GOOGLE_CLOUD_PROJECT
+	TraceExporterGCP = "gcp"
+	// TraceExporterOTLP sends spans to the collector at OTEL_EXPORTER_OTLP_ENDPOINT
+	TraceExporterOTLP = "otlp"
+	// TraceExporterNone keeps spans in process, context is still propagated
+	TraceExporterNone = "none"
 
-	projectID := GetEnv("GOOGLE_CLOUD_PROJECT", "")
+	// TraceIDHeader carries the trace id on outbound webhooks for clients not reading traceparent
+	TraceIDHeader = "X-Trace-ID"
 
-	if projectID != "" {
+	tracerName = "antinvestor.com/service/routep"
+)
 
-		exporter, err := gcpExporter.NewExporter(gcpExporter.WithProjectID(projectID))
-		if err != nil {
-			return err
+var tracerProvider *sdktrace.TracerProvider
+
+// ConfigureTracer Configures an implementation for tracing purposes,
+// TRACE_EXPORTER picks where spans are exported to
+func ConfigureTracer(serviceName string, log *logrus.Entry) error {
+
+	exporterName := GetEnv("TRACE_EXPORTER", "")
+	if exporterName == "" {
+		switch {
+		case GetEnv("GOOGLE_CLOUD_PROJECT", "") != "":
+			exporterName = TraceExporterGCP
+		case GetEnv("OTEL_EXPORTER_OTLP_ENDPOINT", "") != "":
+			exporterName = TraceExporterOTLP
+		default:
+			exporterName = TraceExporterNone
 		}
+	}
 
-		tp, err := sdktrace.NewProvider(sdktrace.WithSyncer(exporter))
+	options := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	}
+
+	switch exporterName {
+	case TraceExporterGCP:
+		exporter, err := gcpExporter.New(gcpExporter.WithProjectID(GetEnv("GOOGLE_CLOUD_PROJECT", "")))
 		if err != nil {
 			return err
 		}
-		global.SetTraceProvider(tp)
+		options = append(options, sdktrace.WithBatcher(exporter))
 
-	}else{
-		tp, err := sdktrace.NewProvider()
+	case TraceExporterOTLP:
+		exporter, err := otlptracehttp.New(context.Background())
 		if err != nil {
 			return err
 		}
-		global.SetTraceProvider(tp)
+		options = append(options, sdktrace.WithBatcher(exporter))
 
+	case TraceExporterNone:
+	default:
+		return fmt.Errorf("unsupported trace exporter : %s", exporterName)
 	}
 
+	log.Infof("exporting traces with the %s exporter", exporterName)
+
+	tracerProvider = sdktrace.NewTracerProvider(options...)
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
 	return nil
 }
+
+// ShutdownTracer flushes the spans still waiting to be exported
+func ShutdownTracer(ctx context.Context) error {
+	if tracerProvider == nil {
+		return nil
+	}
+	return tracerProvider.Shutdown(ctx)
+}
+
+// StartSpan starts a span as a child of any span in the context
+func StartSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name)
+}
+
+// EndSpan records the error if there is one and ends the span
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// InjectTraceContext writes the W3C trace context in the context to a map
+// that travels with queued messages
+func InjectTraceContext(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// ExtractTraceContext continues the trace carried by a queued message
+func ExtractTraceContext(ctx context.Context, traceContext map[string]string) context.Context {
+	if len(traceContext) == 0 {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(traceContext))
+}
+
+// ExtractTraceHeaders continues a trace the caller started
+func ExtractTraceHeaders(ctx context.Context, header http.Header) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+// InjectTraceHeaders adds the trace context and trace id to outbound request headers
+func InjectTraceHeaders(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+
+	spanContext := trace.SpanContextFromContext(ctx)
+	if spanContext.HasTraceID() {
+		header.Set(TraceIDHeader, spanContext.TraceID().String())
+	}
+}
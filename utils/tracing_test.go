@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTraceContextSurvivesQueuedMessages(t *testing.T) {
+
+	otel.SetTracerProvider(sdktrace.NewTracerProvider())
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	ctx, span := StartSpan(context.Background(), "SendSms")
+	defer span.End()
+
+	traceContext := InjectTraceContext(ctx)
+	assert.Contains(t, traceContext, "traceparent")
+
+	_, child := StartSpan(ExtractTraceContext(context.Background(), traceContext), "Submit")
+	defer child.End()
+	assert.Equal(t, span.SpanContext().TraceID(), child.SpanContext().TraceID())
+
+	header := http.Header{}
+	InjectTraceHeaders(trace.ContextWithSpan(context.Background(), child), header)
+	assert.Equal(t, span.SpanContext().TraceID().String(), header.Get(TraceIDHeader))
+	assert.NotEmpty(t, header.Get("traceparent"))
+}
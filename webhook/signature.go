@@ -0,0 +1,114 @@
+// Package webhook holds the helpers for signing the webhook requests the
+// router makes and for verifying them on the receiving side.
+//
+// Each signed request carries an X-Timestamp header with the unix time it was
+// sent at and an X-Signature header of the form "sha256=<hex>", the HMAC-SHA256
+// keyed by the route's webhook secret of
+//
+//	<timestamp>.<method>.<request uri>.<body>
+//
+// e.g. 1700000000.GET./dlr?id=123&status=1. so the query strings of bodiless
+// requests are covered as well.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SignatureHeader carries the request signature
+	SignatureHeader = "X-Signature"
+	// TimestampHeader carries the unix time the request was signed at
+	TimestampHeader = "X-Timestamp"
+
+	signaturePrefix = "sha256="
+)
+
+var (
+	// ErrMissingSignature is returned when a request is not signed
+	ErrMissingSignature = errors.New("webhook request is missing signature headers")
+	// ErrInvalidSignature is returned when the signature does not match the request
+	ErrInvalidSignature = errors.New("webhook signature is invalid")
+	// ErrExpiredTimestamp is returned when a request was signed outside the tolerance
+	ErrExpiredTimestamp = errors.New("webhook timestamp is outside the allowed tolerance")
+)
+
+// Sign computes the signature header value for a request sent at the timestamp,
+// requestURI is the path and query the request was sent to
+func Sign(secret string, timestamp string, method string, requestURI string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write([]byte(strings.ToUpper(method)))
+	mac.Write([]byte("."))
+	mac.Write([]byte(requestURI))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest sets the timestamp and signature headers on an outgoing request
+func SignRequest(r *http.Request, secret string, body []byte, now time.Time) {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	r.Header.Set(TimestampHeader, timestamp)
+	r.Header.Set(SignatureHeader, Sign(secret, timestamp, r.Method, r.URL.RequestURI(), body))
+}
+
+// Verify checks the signature against the timestamp, method, request uri and
+// body. A zero tolerance skips checking how old the timestamp is.
+func Verify(secret string, signature string, timestamp string, method string, requestURI string, body []byte, tolerance time.Duration) error {
+
+	if signature == "" || timestamp == "" {
+		return ErrMissingSignature
+	}
+
+	if tolerance > 0 {
+		seconds, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return ErrInvalidSignature
+		}
+
+		age := time.Since(time.Unix(seconds, 0))
+		if age > tolerance || age < -tolerance {
+			return ErrExpiredTimestamp
+		}
+	}
+
+	if !strings.HasPrefix(signature, signaturePrefix) {
+		return ErrInvalidSignature
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(Sign(secret, timestamp, method, requestURI, body))) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// VerifyRequest checks the signature of an incoming webhook request. The body
+// is read to verify it and then restored so handlers can still read it.
+func VerifyRequest(r *http.Request, secret string, tolerance time.Duration) error {
+
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		_ = r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	return Verify(secret, r.Header.Get(SignatureHeader), r.Header.Get(TimestampHeader), r.Method, r.URL.RequestURI(),
+		body, tolerance)
+}
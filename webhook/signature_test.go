@@ -0,0 +1,63 @@
+package webhook
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyRequest(t *testing.T) {
+
+	body := []byte(`{"message_id":"123","smsc_status":"DELIVRD"}`)
+
+	r, err := http.NewRequest(http.MethodPost, "http://localhost/dlr", bytes.NewReader(body))
+	assert.NoError(t, err)
+	SignRequest(r, "secret", body, time.Now())
+
+	assert.NoError(t, VerifyRequest(r, "secret", time.Minute))
+
+	restored, err := ioutil.ReadAll(r.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, body, restored, "body should remain readable after verification")
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	assert.Equal(t, ErrInvalidSignature, VerifyRequest(r, "another secret", time.Minute))
+
+	r.Body = ioutil.NopCloser(bytes.NewReader([]byte(`{"message_id":"124"}`)))
+	assert.Equal(t, ErrInvalidSignature, VerifyRequest(r, "secret", time.Minute))
+}
+
+func TestVerifyRequestCoversMethodAndQuery(t *testing.T) {
+
+	r, err := http.NewRequest(http.MethodGet, "http://localhost/dlr?id=123&status=1", nil)
+	assert.NoError(t, err)
+	SignRequest(r, "secret", nil, time.Now())
+	assert.NoError(t, VerifyRequest(r, "secret", time.Minute))
+
+	r.URL.RawQuery = "id=124&status=1"
+	assert.Equal(t, ErrInvalidSignature, VerifyRequest(r, "secret", time.Minute), "a swapped query must not verify")
+
+	r.URL.RawQuery = "id=123&status=1"
+	r.Method = http.MethodDelete
+	assert.Equal(t, ErrInvalidSignature, VerifyRequest(r, "secret", time.Minute), "a swapped method must not verify")
+
+	r.Method = http.MethodGet
+	r.URL.Path = "/mt"
+	assert.Equal(t, ErrInvalidSignature, VerifyRequest(r, "secret", time.Minute), "a swapped path must not verify")
+}
+
+func TestVerifyTimestamp(t *testing.T) {
+
+	body := []byte("data")
+	sentAt := strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10)
+	signature := Sign("secret", sentAt, http.MethodPost, "/dlr", body)
+
+	assert.Equal(t, ErrExpiredTimestamp, Verify("secret", signature, sentAt, http.MethodPost, "/dlr", body, 5*time.Minute))
+	assert.NoError(t, Verify("secret", signature, sentAt, http.MethodPost, "/dlr", body, 0))
+	assert.Equal(t, ErrMissingSignature, Verify("secret", "", sentAt, http.MethodPost, "/dlr", body, 0))
+}